@@ -4,13 +4,17 @@ import (
 	"bytes"
 	"context"
 	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-ap/activitypub"
@@ -19,13 +23,15 @@ import (
 )
 
 type ActivityPubObject struct {
-	Id        string               `json:"id"`
-	Name      string               `json:"name"`
-	Content   string               `json:"content"`
-	InReplyTo string               `json:"in_reply_to"`
-	Replies   []*ActivityPubObject `json:"replies"`
-	HtmlUri   string               `json:"html_uri"`
-	UriName   string               `json:"uri_name"`
+	Id           string               `json:"id"`
+	Name         string               `json:"name"`
+	Content      string               `json:"content"`
+	InReplyTo    string               `json:"in_reply_to"`
+	AttributedTo string               `json:"attributed_to"`
+	Published    string               `json:"published"`
+	Replies      []*ActivityPubObject `json:"replies"`
+	HtmlUri      string               `json:"html_uri"`
+	UriName      string               `json:"uri_name"`
 }
 
 func convertApObjects(from []*activitypub.Object) ([]*ActivityPubObject, error) {
@@ -47,27 +53,61 @@ func convertApObject(from *activitypub.Object) (*ActivityPubObject, error) {
 	inReplyTo := ""
 
 	if from.InReplyTo != nil {
-		inReplyTo = string(from.InReplyTo.(activitypub.IRI))
+		inReplyTo = string(from.InReplyTo.GetLink())
+	}
+
+	attributedTo := ""
+
+	if from.AttributedTo != nil {
+		attributedTo = string(from.AttributedTo.GetLink())
+	}
+
+	published := ""
+
+	if !from.Published.IsZero() {
+		published = from.Published.Format(time.RFC3339)
 	}
 
 	htmlUri := ""
 
-	url, err := activitypub.ToLink(from.URL)
-	if err != nil {
-		return nil, err
+	// Our own entries link to their HTML with a Link object, but remote
+	// servers such as Mastodon use a plain IRI
+	if activitypub.IsIRI(from.URL) {
+		htmlUri = string(from.URL.GetLink())
+	} else if from.URL != nil {
+		url, err := activitypub.ToLink(from.URL)
+		if err != nil {
+			return nil, err
+		}
+
+		if url.MediaType == "text/html" {
+			htmlUri = string(url.Href)
+		}
+	}
+
+	// These come from remote servers and end up in links, so anything which
+	// isn't a web URL (say a javascript: URL) is dropped
+	if !isHttpUrl(htmlUri) {
+		htmlUri = ""
 	}
 
-	if url.MediaType == "text/html" {
-		htmlUri = string(url.Href)
+	if !isHttpUrl(inReplyTo) {
+		inReplyTo = ""
+	}
+
+	if !isHttpUrl(attributedTo) {
+		attributedTo = ""
 	}
 
 	to := &ActivityPubObject{
-		Id:        string(from.ID),
-		HtmlUri:   htmlUri,
-		Name:      string(from.Name.First().Value),
-		Content:   string(from.Content.First().Value),
-		InReplyTo: inReplyTo,
-		Replies:   []*ActivityPubObject{},
+		Id:           string(from.ID),
+		HtmlUri:      htmlUri,
+		Name:         string(from.Name.First().Value),
+		Content:      string(from.Content.First().Value),
+		InReplyTo:    inReplyTo,
+		AttributedTo: attributedTo,
+		Published:    published,
+		Replies:      []*ActivityPubObject{},
 	}
 
 	if from.Replies != nil {
@@ -143,13 +183,12 @@ func getTree(apClient *client.C, uri activitypub.IRI, depth int) (*activitypub.O
 
 func getObject(apClient *client.C, uri activitypub.IRI) (*activitypub.Object, error) {
 
-	parsedUri, err := url.Parse(string(uri))
+	_, err := url.Parse(string(uri))
 	if err != nil {
 		return nil, err
 	}
 
-	cacheDir := "ap_cache"
-	objCachePath := filepath.Join(cacheDir, parsedUri.Host, parsedUri.Path)
+	objCachePath := getCachePath(uri)
 	objCacheDir := filepath.Dir(objCachePath)
 
 	err = os.MkdirAll(objCacheDir, 0755)
@@ -273,6 +312,133 @@ func getObject(apClient *client.C, uri activitypub.IRI) (*activitypub.Object, er
 	return obj, nil
 }
 
+// getCachePath returns where a remote object fetched from uri is cached.
+// It's a hash of the URI we asked for, so neither the URI nor anything in
+// the document can point it outside of the cache.
+func getCachePath(uri activitypub.IRI) string {
+	hash := sha256.Sum256([]byte(uri))
+	return filepath.Join("ap_cache", hex.EncodeToString(hash[:])+".jsonld")
+}
+
+// isSameHost checks whether two IRIs are on the same server. That's as far
+// as we can trust an actor to speak for an object, since anyone can put any
+// ID on what they send.
+func isSameHost(a, b activitypub.IRI) bool {
+
+	parsedA, err := url.Parse(string(a))
+	if err != nil {
+		return false
+	}
+
+	parsedB, err := url.Parse(string(b))
+	if err != nil {
+		return false
+	}
+
+	return parsedA.Host != "" && strings.EqualFold(parsedA.Host, parsedB.Host)
+}
+
+func getActor(apClient *client.C, uri activitypub.IRI) (*activitypub.Actor, error) {
+
+	actorCacheBytes, err := os.ReadFile(getCachePath(uri))
+	if err == nil {
+		var cachedActor *activitypub.Actor
+		err = jsonld.Unmarshal(actorCacheBytes, &cachedActor)
+		// Objects cached by getObject don't include a public key, so those
+		// need to be fetched again
+		if err == nil && cachedActor.ID == uri && cachedActor.PublicKey.PublicKeyPem != "" {
+			return cachedActor, nil
+		}
+	}
+
+	return fetchActor(apClient, uri)
+}
+
+// fetchActor loads an actor from its server, skipping the cache, and caches
+// the result. The actor has to be the one at uri, otherwise any server could
+// hand out documents claiming to be someone else.
+func fetchActor(apClient *client.C, uri activitypub.IRI) (*activitypub.Actor, error) {
+
+	ctx := context.Background()
+
+	item, err := apClient.CtxLoadIRI(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+
+	actor, err := activitypub.ToActor(item)
+	if err != nil {
+		return nil, err
+	}
+
+	if actor.ID != uri {
+		return nil, fmt.Errorf("actor fetched from %s has id %s", uri, actor.ID)
+	}
+
+	err = cacheActor(actor)
+	if err != nil {
+		return nil, err
+	}
+
+	return actor, nil
+}
+
+// cacheActor caches an actor under its ID, so the ID needs to have been
+// checked against where the actor came from.
+func cacheActor(actor *activitypub.Actor) error {
+
+	actorWriteBytes, err := jsonld.Marshal(actor)
+	if err != nil {
+		return err
+	}
+
+	return ensureDirWriteFile(getCachePath(actor.ID), actorWriteBytes)
+}
+
+// updateActor replaces our copies of a remote actor after they send an
+// Update for themselves. The caller has to have checked that actor is the
+// one who signed the Update.
+func updateActor(db *SqliteDatabase, actor *activitypub.Actor) error {
+
+	// We verify signatures against the cached actor, so don't let a
+	// partial Update drop the key
+	if actor.PublicKey.PublicKeyPem != "" {
+		err := cacheActor(actor)
+		if err != nil {
+			return err
+		}
+	}
+
+	return db.UpdateReactionActor(string(actor.ID), getActorName(actor), getActorIcon(actor))
+}
+
+func getFollower(apClient *client.C, domain string, actorId activitypub.IRI) (*Follower, error) {
+
+	actor, err := getActor(apClient, actorId)
+	if err != nil {
+		return nil, err
+	}
+
+	follower := &Follower{
+		Domain: domain,
+		Actor:  string(actor.ID),
+	}
+
+	if actor.Inbox != nil {
+		follower.Inbox = string(actor.Inbox.GetLink())
+	}
+
+	if actor.Endpoints != nil && actor.Endpoints.SharedInbox != nil {
+		follower.SharedInbox = string(actor.Endpoints.SharedInbox.GetLink())
+	}
+
+	if follower.Inbox == "" && follower.SharedInbox == "" {
+		return nil, fmt.Errorf("actor %s has no inbox", actor.ID)
+	}
+
+	return follower, nil
+}
+
 func getIri(apClient *client.C, item activitypub.Item) (activitypub.IRI, error) {
 	var iri activitypub.IRI
 	if item.IsLink() {
@@ -301,6 +467,11 @@ func sendActivity(httpClient *http.Client, privKey *rsa.PrivateKey, pubKeyId str
 		return err
 	}
 
+	return postActivity(httpClient, privKey, pubKeyId, activityJsonBytes, uri)
+}
+
+func postActivity(httpClient *http.Client, privKey *rsa.PrivateKey, pubKeyId string, activityJsonBytes []byte, uri string) error {
+
 	req, err := http.NewRequest("POST", uri, bytes.NewReader(activityJsonBytes))
 	if err != nil {
 		return err
@@ -314,6 +485,7 @@ func sendActivity(httpClient *http.Client, privKey *rsa.PrivateKey, pubKeyId str
 	dateHeader := time.Now().UTC().Format(http.TimeFormat)
 
 	req.Header.Set("Accept", "application/activity+json")
+	req.Header.Set("Content-Type", "application/activity+json")
 	req.Header.Set("Date", dateHeader)
 	req.Header.Set("Host", parsedUrl.Host)
 
@@ -326,12 +498,71 @@ func sendActivity(httpClient *http.Client, privKey *rsa.PrivateKey, pubKeyId str
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
 
 	fmt.Println(resp.StatusCode)
 
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &postError{
+			uri:        uri,
+			statusCode: resp.StatusCode,
+			body:       string(body),
+		}
+	}
+
 	return nil
 }
 
+// postError is returned by postActivity when the inbox answers with an error
+// status.
+type postError struct {
+	uri        string
+	statusCode int
+	body       string
+}
+
+func (e *postError) Error() string {
+	return fmt.Sprintf("%s returned %d: %s", e.uri, e.statusCode, e.body)
+}
+
+// isPermanent checks whether the inbox rejected the activity itself, in
+// which case sending it again won't help.
+func (e *postError) isPermanent() bool {
+	switch e.statusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return false
+	}
+
+	return e.statusCode >= 400 && e.statusCode <= 499
+}
+
+// getDeliveryInboxes returns the inboxes an activity needs to be sent to in
+// order to reach all the given followers, using shared inboxes where
+// possible so each server only receives it once.
+func getDeliveryInboxes(followers []*Follower) []string {
+
+	inboxes := []string{}
+
+	for _, follower := range followers {
+		inbox := follower.SharedInbox
+		if inbox == "" {
+			inbox = follower.Inbox
+		}
+
+		// Legacy followers don't have an inbox until they're resolved
+		if inbox == "" {
+			continue
+		}
+
+		if !stringInArray(inbox, inboxes) {
+			inboxes = append(inboxes, inbox)
+		}
+	}
+
+	return inboxes
+}
+
 func filterRootEntries(entries []*activitypub.Object) []*activitypub.Object {
 
 	rootEntries := []*activitypub.Object{}
@@ -367,6 +598,10 @@ func getAllEntries(entriesDir string) ([]*activitypub.Object, error) {
 		entryTextPath := filepath.Join(entryDir, "activity.jsonld")
 
 		activityBytes, err := os.ReadFile(entryTextPath)
+		if os.IsNotExist(err) {
+			// Deleted entries only have a Tombstone left
+			continue
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -387,6 +622,11 @@ func getAllEntries(entriesDir string) ([]*activitypub.Object, error) {
 			return nil, err
 		}
 
+		err = loadHashtags(activityBytes, entry)
+		if err != nil {
+			return nil, err
+		}
+
 		entries = append(entries, entry)
 	}
 
@@ -0,0 +1,239 @@
+package syndicat
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-ap/activitypub"
+	"github.com/go-ap/client"
+)
+
+// resolveBlockTarget turns what was entered in the block form, or read from
+// a CSV file, into something to block. Actor URIs and handles such as
+// @user@example.com become actor IDs, and anything else is taken to be a
+// domain.
+func resolveBlockTarget(httpClient *http.Client, target string) (string, error) {
+
+	target = strings.TrimSpace(target)
+	if target == "" {
+		return "", errors.New("Nothing to block")
+	}
+
+	if isHttpUrl(target) || strings.Contains(target, "@") {
+		actorId, err := resolveHandle(httpClient, target)
+		if err != nil {
+			return "", err
+		}
+
+		return string(actorId), nil
+	}
+
+	domain := strings.ToLower(strings.TrimSuffix(target, "."))
+	if strings.ContainsAny(domain, "/:? ") || !strings.Contains(domain, ".") {
+		return "", fmt.Errorf("Invalid domain %s", target)
+	}
+
+	return domain, nil
+}
+
+// block adds target, an actor ID or a domain, to the blocklist of domain and
+// removes any followers it covers. If sendBlock is set and target is an
+// actor, it returns a Block activity to let them know, along with the inbox
+// it needs to be delivered to.
+func block(db *SqliteDatabase, apClient *client.C, serveDir, domain, target string, sendBlock bool) (*activitypub.Activity, string, error) {
+
+	err := db.SetBlock(&Block{
+		Domain:  domain,
+		Target:  target,
+		Created: time.Now(),
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	followers, err := db.GetFollowers(domain)
+	if err != nil {
+		return nil, "", err
+	}
+
+	for _, follower := range followers {
+		blocked, err := db.IsBlocked(domain, follower.Actor)
+		if err != nil {
+			return nil, "", err
+		}
+
+		if !blocked {
+			continue
+		}
+
+		err = db.DeleteFollower(domain, follower.Actor)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	err = writeFollowersCollection(db, filepath.Join(serveDir, domain), domain)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Domains don't have an inbox to tell
+	if !sendBlock || !isHttpUrl(target) {
+		return nil, "", nil
+	}
+
+	actor, err := getActor(apClient, activitypub.IRI(target))
+	if err != nil {
+		return nil, "", err
+	}
+
+	if actor.Inbox == nil {
+		return nil, "", fmt.Errorf("actor %s has no inbox", actor.ID)
+	}
+
+	actorId := activitypub.IRI(fmt.Sprintf("https://%s/ap.jsonld", domain))
+	blockId := activitypub.IRI(fmt.Sprintf("%s#blocks/%d", actorId, time.Now().UnixNano()))
+
+	blockAct := &activitypub.Activity{
+		ID:     blockId,
+		Type:   activitypub.BlockType,
+		Actor:  actorId,
+		Object: actor.ID,
+		To: activitypub.ItemCollection{
+			actor.ID,
+		},
+	}
+
+	return blockAct, string(actor.Inbox.GetLink()), nil
+}
+
+// rejectFollow returns a Reject of a Follow of domain, along with the inbox
+// of the actor who sent it.
+func rejectFollow(apClient *client.C, domain string, follow *activitypub.Activity) (*activitypub.Activity, string, error) {
+
+	follower, err := getFollower(apClient, domain, follow.Actor.GetID())
+	if err != nil {
+		return nil, "", err
+	}
+
+	actorId := activitypub.IRI(fmt.Sprintf("https://%s/ap.jsonld", domain))
+	rejectId := activitypub.IRI(fmt.Sprintf("%s#rejects/follows/%d", actorId, time.Now().UnixNano()))
+
+	reject := &activitypub.Reject{
+		ID:     rejectId,
+		Type:   activitypub.RejectType,
+		Actor:  actorId,
+		Object: follow,
+	}
+
+	inbox := follower.Inbox
+	if inbox == "" {
+		inbox = follower.SharedInbox
+	}
+
+	return reject, inbox, nil
+}
+
+// parseBlocksCsv reads the targets from a Mastodon blocklist export. Domain
+// blocks have a header row and the domain in the first column, while
+// account blocks are just one account per line.
+func parseBlocksCsv(r io.Reader) ([]string, error) {
+
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	targets := []string{}
+
+	for _, record := range records {
+		if len(record) == 0 {
+			continue
+		}
+
+		target := strings.TrimSpace(record[0])
+		if target == "" || strings.HasPrefix(target, "#") {
+			continue
+		}
+
+		targets = append(targets, target)
+	}
+
+	return targets, nil
+}
+
+// getDomainBlocksCsv exports the domains domain blocks in the format of
+// Mastodon's domain_blocks.csv.
+func getDomainBlocksCsv(blocks []*Block) ([]byte, error) {
+
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+
+	err := writer.Write([]string{"#domain", "#severity", "#reject_media", "#reject_reports", "#public_comment", "#obfuscate"})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, b := range blocks {
+		if isHttpUrl(b.Target) {
+			continue
+		}
+
+		err = writer.Write([]string{b.Target, "suspend", "false", "false", "", "false"})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	writer.Flush()
+
+	return buf.Bytes(), writer.Error()
+}
+
+// getAccountBlocksCsv exports the actors domain blocks in the format of
+// Mastodon's blocked_accounts.csv, which uses user@example.com handles.
+func getAccountBlocksCsv(apClient *client.C, blocks []*Block) ([]byte, error) {
+
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+
+	for _, b := range blocks {
+		if !isHttpUrl(b.Target) {
+			continue
+		}
+
+		actor, err := getActor(apClient, activitypub.IRI(b.Target))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to export block of %s: %s\n", b.Target, err.Error())
+			continue
+		}
+
+		parsedId, err := url.Parse(string(actor.ID))
+		if err != nil {
+			return nil, err
+		}
+
+		handle := fmt.Sprintf("%s@%s", actor.PreferredUsername.First().Value, parsedId.Host)
+
+		err = writer.Write([]string{handle})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	writer.Flush()
+
+	return buf.Bytes(), writer.Error()
+}
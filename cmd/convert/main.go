@@ -121,14 +121,10 @@ func main() {
 		htmlLink.Href = activitypub.IRI(entryUri)
 		htmlLink.MediaType = "text/html"
 
-		to := activitypub.ItemCollection{
-			activitypub.IRI("https://www.w3.org/ns/activitystreams#Public"),
-		}
+		visibility, err := syndicat.ParseVisibility(legacyEntry.Visibility)
+		exitOnErr(err)
 
-		followersId := activitypub.IRI(fmt.Sprintf("https://%s/followers.jsonld", host))
-		cc := activitypub.ItemCollection{
-			activitypub.IRI(followersId),
-		}
+		to, cc := syndicat.GetAddressing(host, visibility)
 
 		entry := &activitypub.Object{
 			Type: activitypub.ArticleType,
@@ -163,6 +159,7 @@ func main() {
 
 		dbEntry := &syndicat.Entry{
 			Id:            entryId,
+			Domain:        host,
 			Title:         legacyEntry.Title,
 			Author:        host,
 			PublishedTime: timestamp,
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	"github.com/anderspitman/syndicat-go"
 )
@@ -11,13 +16,33 @@ func main() {
 	rootUri := flag.String("root-uri", "", "Root URI")
 	templatesDir := flag.String("templates-dir", "templates", "Templates directory")
 	port := flag.Int("port", 9005, "Port")
+	authorizedFetch := flag.Bool("authorized-fetch", false, "Require signatures to fetch ActivityPub objects")
+	dbPath := flag.String("db-path", "entree_db.sqlite", "Database path")
+	filesDir := flag.String("files-dir", "files", "Directory of the hosted domains' files")
+	trustedProxies := flag.String("trusted-proxies", "127.0.0.1,::1", "Comma-separated addresses of reverse proxies allowed to set X-Forwarded-Host")
 	flag.Parse()
 
 	config := syndicat.ServerConfig{
-		RootUri:      *rootUri,
-		TemplatesDir: *templatesDir,
-		Port:         *port,
+		RootUri:         *rootUri,
+		TemplatesDir:    *templatesDir,
+		Port:            *port,
+		AuthorizedFetch: *authorizedFetch,
+		TrustedProxies:  strings.Split(*trustedProxies, ","),
+		DbPath:          *dbPath,
+		FilesDir:        *filesDir,
+	}
+	server, err := syndicat.NewServer(config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	err = server.Start(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
 	}
-	server := syndicat.NewServer(config)
-	fmt.Println(server)
 }
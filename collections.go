@@ -0,0 +1,111 @@
+package syndicat
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-ap/activitypub"
+)
+
+const collectionPageSize = 20
+
+// Collections are rewritten by the inbox handlers as well as render, which
+// can run at the same time
+var collectionsMut sync.Mutex
+
+// writePagedCollection publishes items, which must already be ordered
+// newest first, as an OrderedCollection at <name>.jsonld which only carries
+// totalItems and links to its pages. The pages themselves are written to
+// <name>/<n>.jsonld, starting at 1. Pages are replaced one at a time, so
+// readers never find them missing.
+func writePagedCollection(userServeDir, domain, name string, items activitypub.ItemCollection) error {
+
+	collectionsMut.Lock()
+	defer collectionsMut.Unlock()
+
+	collectionId := activitypub.IRI(fmt.Sprintf("https://%s/%s.jsonld", domain, name))
+
+	pageId := func(pageNum int) activitypub.IRI {
+		return activitypub.IRI(fmt.Sprintf("https://%s/%s/%d.jsonld", domain, name, pageNum))
+	}
+
+	// Always publish at least one page, since some servers expect first to
+	// be there even for empty collections
+	numPages := (len(items) + collectionPageSize - 1) / collectionPageSize
+	if numPages == 0 {
+		numPages = 1
+	}
+
+	pagesDir := filepath.Join(userServeDir, name)
+
+	err := ensureDir(pagesDir)
+	if err != nil {
+		return err
+	}
+
+	for pageNum := 1; pageNum <= numPages; pageNum++ {
+
+		start := (pageNum - 1) * collectionPageSize
+		end := start + collectionPageSize
+		if end > len(items) {
+			end = len(items)
+		}
+
+		page := &activitypub.OrderedCollectionPage{
+			ID:           pageId(pageNum),
+			Type:         activitypub.OrderedCollectionPageType,
+			PartOf:       collectionId,
+			TotalItems:   uint(len(items)),
+			OrderedItems: items[start:end],
+		}
+
+		if pageNum > 1 {
+			page.Prev = pageId(pageNum - 1)
+		}
+
+		if pageNum < numPages {
+			page.Next = pageId(pageNum + 1)
+		}
+
+		pagePath := filepath.Join(pagesDir, fmt.Sprintf("%d.jsonld", pageNum))
+
+		err = writeOrderedCollectionPage(pagePath, page)
+		if err != nil {
+			return err
+		}
+	}
+
+	collection := activitypub.OrderedCollectionNew(collectionId)
+	collection.TotalItems = uint(len(items))
+	collection.First = pageId(1)
+	collection.Last = pageId(numPages)
+
+	err = writeOrderedCollection(filepath.Join(userServeDir, name+".jsonld"), collection)
+	if err != nil {
+		return err
+	}
+
+	// Clear out pages left over from when the collection was bigger
+	dirItems, err := os.ReadDir(pagesDir)
+	if err != nil {
+		return err
+	}
+
+	for _, item := range dirItems {
+		pageNum, err := strconv.Atoi(strings.TrimSuffix(item.Name(), ".jsonld"))
+		if err != nil || pageNum <= numPages {
+			continue
+		}
+
+		err = os.Remove(filepath.Join(pagesDir, item.Name()))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -5,17 +5,27 @@ import (
 	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/pem"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
+	"time"
 
+	"github.com/go-ap/activitypub"
+	"github.com/go-ap/client"
 	"github.com/go-fed/httpsig"
 )
 
+// Mastodon allows 12 hours of clock skew, so we do the same
+const maxSignatureAge = 12 * time.Hour
+
 func MakeRSAKey() (*rsa.PrivateKey, error) {
 	privKey, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
@@ -100,3 +110,159 @@ func sign(privateKey crypto.PrivateKey, pubKeyId string, r *http.Request) error
 
 	return signer.SignRequest(privateKey, pubKeyId, r, body)
 }
+
+func ParsePublicKeyPem(publicKeyPem string) (crypto.PublicKey, error) {
+	block, _ := pem.Decode([]byte(publicKeyPem))
+	if block == nil {
+		return nil, errors.New("failed to parse PEM block containing the public key")
+	}
+
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	case "PUBLIC KEY":
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	}
+
+	return nil, fmt.Errorf("unsupported public key type %s", block.Type)
+}
+
+// verifyRequest checks the HTTP Signature and Digest of an incoming request
+// against the public key of the signing actor, and returns that actor's ID.
+func verifyRequest(apClient *client.C, r *http.Request, body []byte) (activitypub.IRI, error) {
+
+	// The Host header is moved to r.Host by net/http, and might have been
+	// rewritten by a reverse proxy
+	r.Header.Set("Host", getHost(r))
+
+	verifier, err := httpsig.NewVerifier(r)
+	if err != nil {
+		return "", err
+	}
+
+	dateHeader := r.Header.Get("Date")
+	if dateHeader == "" {
+		return "", errors.New("missing Date header")
+	}
+
+	date, err := http.ParseTime(dateHeader)
+	if err != nil {
+		return "", err
+	}
+
+	age := time.Since(date)
+	if age > maxSignatureAge || age < -maxSignatureAge {
+		return "", errors.New("signature expired")
+	}
+
+	signedHeaders, err := getSignedHeaders(r.Header.Get("Signature"))
+	if err != nil {
+		return "", err
+	}
+
+	if !stringInArray("date", signedHeaders) {
+		return "", errors.New("date header not signed")
+	}
+
+	if r.Method == http.MethodPost {
+		if !stringInArray("digest", signedHeaders) {
+			return "", errors.New("digest header not signed")
+		}
+
+		err = verifyDigest(r.Header.Get("Digest"), body)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	keyId := activitypub.IRI(verifier.KeyId())
+
+	parsedKeyId, err := url.Parse(string(keyId))
+	if err != nil {
+		return "", err
+	}
+	parsedKeyId.Fragment = ""
+
+	actorId := activitypub.IRI(parsedKeyId.String())
+
+	actor, err := getActor(apClient, actorId)
+	if err != nil {
+		return "", err
+	}
+
+	err = verifyWithActor(verifier, keyId, actor)
+	if err != nil {
+		// The actor might have rotated their key since we cached them
+		actor, err = fetchActor(apClient, actorId)
+		if err != nil {
+			return "", err
+		}
+
+		err = verifyWithActor(verifier, keyId, actor)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return actor.ID, nil
+}
+
+// verifyWithActor checks a signature against the key of actor, which has to
+// be the one keyId names and belong to actor.
+func verifyWithActor(verifier httpsig.Verifier, keyId activitypub.IRI, actor *activitypub.Actor) error {
+
+	if actor.PublicKey.ID != keyId {
+		return fmt.Errorf("key %s does not belong to actor %s", keyId, actor.ID)
+	}
+
+	if actor.PublicKey.Owner != actor.ID {
+		return fmt.Errorf("key %s is owned by %s, not %s", keyId, actor.PublicKey.Owner, actor.ID)
+	}
+
+	pubKey, err := ParsePublicKeyPem(actor.PublicKey.PublicKeyPem)
+	if err != nil {
+		return err
+	}
+
+	return verifier.Verify(pubKey, httpsig.RSA_SHA256)
+}
+
+func getSignedHeaders(signatureHeader string) ([]string, error) {
+	for _, param := range strings.Split(signatureHeader, ",") {
+		parts := strings.SplitN(param, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("malformed signature parameter %s", param)
+		}
+
+		if strings.TrimSpace(parts[0]) == "headers" {
+			headers := strings.Trim(parts[1], `"`)
+			return strings.Split(strings.ToLower(headers), " "), nil
+		}
+	}
+
+	// Per the spec, only the Date header is signed if headers is omitted
+	return []string{"date"}, nil
+}
+
+func verifyDigest(digestHeader string, body []byte) error {
+
+	if digestHeader == "" {
+		return errors.New("missing Digest header")
+	}
+
+	parts := strings.SplitN(digestHeader, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("malformed Digest header %s", digestHeader)
+	}
+
+	if strings.ToUpper(parts[0]) != "SHA-256" {
+		return fmt.Errorf("unsupported digest algorithm %s", parts[0])
+	}
+
+	sum := sha256.Sum256(body)
+	if base64.StdEncoding.EncodeToString(sum[:]) != parts[1] {
+		return errors.New("digest header does not match body")
+	}
+
+	return nil
+}
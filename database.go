@@ -1,8 +1,11 @@
 package syndicat
 
 import (
+	"database/sql"
 	//"errors"
-	//"fmt"
+	"fmt"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/jmoiron/sqlx"
@@ -18,6 +21,7 @@ type SqliteDatabase struct {
 
 type Entry struct {
 	Id            int
+	Domain        string
 	Title         string
 	Author        string
 	PublishedTime time.Time
@@ -27,6 +31,94 @@ type Entry struct {
 	Tags          []string
 }
 
+type Follower struct {
+	Domain      string
+	Actor       string
+	Inbox       string
+	SharedInbox string
+	// The ID of the Follow activity, which is empty for legacy followers
+	FollowId string
+}
+
+type Delivery struct {
+	Id int
+	// The hosted domain sending the activity, whose key signs it
+	Domain      string
+	ActivityId  string
+	Activity    string
+	Inbox       string
+	Attempts    int
+	NextAttempt time.Time
+	LastError   string
+	Status      string
+}
+
+type Reply struct {
+	Domain    string
+	EntryId   int
+	Id        string
+	InReplyTo string
+	Actor     string
+	Object    string
+	Published time.Time
+}
+
+type Reaction struct {
+	Domain    string
+	EntryId   int
+	Type      string
+	Id        string
+	Actor     string
+	ActorName string
+	ActorIcon string
+	Published time.Time
+}
+
+const (
+	FollowingStatusPending  = "pending"
+	FollowingStatusAccepted = "accepted"
+)
+
+// Following is a remote actor which one of our users follows, or has asked to
+// follow.
+type Following struct {
+	Domain      string
+	Actor       string
+	FollowId    string
+	Inbox       string
+	SharedInbox string
+	Status      string
+}
+
+// FollowRequest is a Follow waiting for one of our users to approve it.
+type FollowRequest struct {
+	Domain    string
+	Actor     string
+	ActorName string
+	ActorIcon string
+	Activity  string
+	Created   time.Time
+}
+
+// Block is a remote actor, or a whole remote domain, which one of our users
+// doesn't want anything to do with.
+type Block struct {
+	Domain  string
+	Target  string
+	Created time.Time
+}
+
+// TimelineItem is a post from an account one of our users follows.
+type TimelineItem struct {
+	Domain    string
+	Id        string
+	Actor     string
+	ActorName string
+	ActorIcon string
+	Object    string
+	Published time.Time
+}
+
 type DbConfig struct {
 	JwksJson string `json:"jwks_json"`
 }
@@ -38,6 +130,10 @@ func NewDatabase(dbPath string) (*SqliteDatabase, error) {
 		return nil, err
 	}
 
+	// The delivery workers write from multiple goroutines, and SQLite
+	// only supports a single writer
+	sdb.SetMaxOpenConns(1)
+
 	stmt := `
         PRAGMA foreign_keys = ON;
         `
@@ -89,17 +185,254 @@ func NewDatabase(dbPath string) (*SqliteDatabase, error) {
 		return nil, err
 	}
 
+	// Tags used to only be recorded by cmd/convert, for a single domain and
+	// referencing the entries table, which live entries aren't stored in.
+	// The domain isn't known here, so AssignLegacyTags fills it in.
+	stmt = `
+        SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name='tags';
+        `
+	var numTagsTables int
+	err = sdb.QueryRow(stmt).Scan(&numTagsTables)
+	if err != nil {
+		return nil, err
+	}
+
+	stmt = `
+        SELECT COUNT(*) FROM pragma_table_info('tags') WHERE name='domain';
+        `
+	var numDomainColumns int
+	err = sdb.QueryRow(stmt).Scan(&numDomainColumns)
+	if err != nil {
+		return nil, err
+	}
+
+	migrateTags := numTagsTables > 0 && numDomainColumns == 0
+
+	if migrateTags {
+		stmt = `
+                ALTER TABLE tags RENAME TO legacy_tags;
+                `
+		_, err = sdb.Exec(stmt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	stmt = `
         CREATE TABLE IF NOT EXISTS tags(
+                domain TEXT,
                 tag TEXT,
-                entry_id TEXT,
-                FOREIGN KEY(entry_id) REFERENCES entries(id)
+                entry_id INTEGER,
+                UNIQUE(domain,tag,entry_id)
+        );
+        `
+	_, err = sdb.Exec(stmt)
+	if err != nil {
+		return nil, err
+	}
+
+	if migrateTags {
+		stmt = `
+                INSERT OR IGNORE INTO tags(domain,tag,entry_id) SELECT '',tag,entry_id FROM legacy_tags;
+                DROP TABLE legacy_tags;
+                `
+		_, err = sdb.Exec(stmt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	stmt = `
+        CREATE TABLE IF NOT EXISTS followers(
+                domain TEXT,
+                actor TEXT,
+                inbox TEXT,
+                shared_inbox TEXT,
+                follow_id TEXT DEFAULT '',
+                UNIQUE(domain, actor)
+        );
+        `
+	_, err = sdb.Exec(stmt)
+	if err != nil {
+		return nil, err
+	}
+
+	// The ID of the Follow is kept so it can be undone by IRI
+	stmt = `
+        SELECT COUNT(*) FROM pragma_table_info('followers') WHERE name='follow_id';
+        `
+	var numFollowIdColumns int
+	err = sdb.QueryRow(stmt).Scan(&numFollowIdColumns)
+	if err != nil {
+		return nil, err
+	}
+
+	if numFollowIdColumns == 0 {
+		stmt = `
+                ALTER TABLE followers ADD COLUMN follow_id TEXT DEFAULT '';
+                `
+		_, err = sdb.Exec(stmt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	stmt = `
+        CREATE TABLE IF NOT EXISTS deliveries(
+                id INTEGER PRIMARY KEY,
+                domain TEXT DEFAULT '',
+                activity_id TEXT,
+                activity TEXT,
+                inbox TEXT,
+                attempts INTEGER DEFAULT 0,
+                next_attempt INTEGER,
+                last_error TEXT DEFAULT '',
+                status TEXT
+        );
+        `
+	_, err = sdb.Exec(stmt)
+	if err != nil {
+		return nil, err
+	}
+
+	// Deliveries queued before domains signed their own are left with an
+	// empty domain, and are signed by the root domain
+	stmt = `
+        SELECT COUNT(*) FROM pragma_table_info('deliveries') WHERE name='domain';
+        `
+	var numDeliveryDomainColumns int
+	err = sdb.QueryRow(stmt).Scan(&numDeliveryDomainColumns)
+	if err != nil {
+		return nil, err
+	}
+
+	if numDeliveryDomainColumns == 0 {
+		stmt = `
+                ALTER TABLE deliveries ADD COLUMN domain TEXT DEFAULT '';
+                `
+		_, err = sdb.Exec(stmt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	stmt = `
+        CREATE TABLE IF NOT EXISTS dead_inboxes(
+                inbox TEXT UNIQUE,
+                timestamp INTEGER
+        );
+        `
+	_, err = sdb.Exec(stmt)
+	if err != nil {
+		return nil, err
+	}
+
+	stmt = `
+        CREATE TABLE IF NOT EXISTS failing_inboxes(
+                inbox TEXT UNIQUE,
+                since INTEGER
+        );
+        `
+	_, err = sdb.Exec(stmt)
+	if err != nil {
+		return nil, err
+	}
+
+	stmt = `
+        CREATE TABLE IF NOT EXISTS replies(
+                domain TEXT,
+                entry_id INTEGER,
+                id TEXT UNIQUE,
+                in_reply_to TEXT,
+                actor TEXT,
+                object TEXT,
+                published INTEGER
+        );
+        `
+	_, err = sdb.Exec(stmt)
+	if err != nil {
+		return nil, err
+	}
+
+	stmt = `
+        CREATE TABLE IF NOT EXISTS reactions(
+                domain TEXT,
+                entry_id INTEGER,
+                type TEXT,
+                id TEXT UNIQUE,
+                actor TEXT,
+                actor_name TEXT,
+                actor_icon TEXT,
+                published INTEGER
+        );
+        `
+	_, err = sdb.Exec(stmt)
+	if err != nil {
+		return nil, err
+	}
+
+	stmt = `
+        CREATE TABLE IF NOT EXISTS following(
+                domain TEXT,
+                actor TEXT,
+                follow_id TEXT,
+                inbox TEXT,
+                shared_inbox TEXT,
+                status TEXT,
+                UNIQUE(domain, actor)
+        );
+        `
+	_, err = sdb.Exec(stmt)
+	if err != nil {
+		return nil, err
+	}
+
+	stmt = `
+        CREATE TABLE IF NOT EXISTS timeline(
+                domain TEXT,
+                id TEXT,
+                actor TEXT,
+                actor_name TEXT,
+                actor_icon TEXT,
+                object TEXT,
+                published INTEGER,
+                UNIQUE(domain, id)
+        );
+        `
+	_, err = sdb.Exec(stmt)
+	if err != nil {
+		return nil, err
+	}
+
+	stmt = `
+        CREATE TABLE IF NOT EXISTS follow_requests(
+                domain TEXT,
+                actor TEXT,
+                actor_name TEXT,
+                actor_icon TEXT,
+                activity TEXT,
+                created INTEGER,
+                UNIQUE(domain, actor)
+        );
+        `
+	_, err = sdb.Exec(stmt)
+	if err != nil {
+		return nil, err
+	}
+
+	stmt = `
+        CREATE TABLE IF NOT EXISTS blocks(
+                domain TEXT,
+                target TEXT,
+                created INTEGER,
+                UNIQUE(domain, target)
         );
         `
 	_, err = sdb.Exec(stmt)
 	if err != nil {
 		return nil, err
 	}
+
 	db := &SqliteDatabase{
 		sdb: sdb,
 	}
@@ -107,6 +440,10 @@ func NewDatabase(dbPath string) (*SqliteDatabase, error) {
 	return db, nil
 }
 
+func (d *SqliteDatabase) Close() error {
+	return d.sdb.Close()
+}
+
 func (d *SqliteDatabase) GetConfig() (*DbConfig, error) {
 	var c DbConfig
 
@@ -140,11 +477,42 @@ func (d *SqliteDatabase) AddEntry(e *Entry) error {
 		return err
 	}
 
+	tags := []string{}
 	for _, tag := range e.Tags {
+		tags = append(tags, normalizeTag(tag))
+	}
+
+	return d.SetEntryTags(e.Domain, e.Id, tags)
+}
+
+// AssignLegacyTags gives tags migrated from before tags had a domain to
+// domain, which cmd/convert only ever used for the main one.
+func (d *SqliteDatabase) AssignLegacyTags(domain string) error {
+	stmt := `
+        UPDATE OR IGNORE tags SET domain=? WHERE domain='';
+        DELETE FROM tags WHERE domain='';
+        `
+	_, err := d.sdb.Exec(stmt, domain)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// SetEntryTags replaces the tags recorded for an entry.
+func (d *SqliteDatabase) SetEntryTags(domain string, entryId int, tags []string) error {
+
+	err := d.DeleteEntryTags(domain, entryId)
+	if err != nil {
+		return err
+	}
+
+	for _, tag := range tags {
 		stmt := `
-                INSERT INTO tags(tag,entry_id) VALUES(?,?);
+                INSERT OR IGNORE INTO tags(domain,tag,entry_id) VALUES(?,?,?);
                 `
-		_, err := d.sdb.Exec(stmt, tag, e.Id)
+		_, err := d.sdb.Exec(stmt, domain, tag, entryId)
 		if err != nil {
 			return err
 		}
@@ -152,3 +520,890 @@ func (d *SqliteDatabase) AddEntry(e *Entry) error {
 
 	return nil
 }
+
+func (d *SqliteDatabase) DeleteEntryTags(domain string, entryId int) error {
+	stmt := `
+        DELETE FROM tags WHERE domain=? AND entry_id=?;
+        `
+	_, err := d.sdb.Exec(stmt, domain, entryId)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetTags returns every tag used on a domain, in alphabetical order.
+func (d *SqliteDatabase) GetTags(domain string) ([]string, error) {
+	stmt := `
+        SELECT DISTINCT tag FROM tags WHERE domain=? ORDER BY tag;
+        `
+	rows, err := d.sdb.Query(stmt, domain)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := []string{}
+
+	for rows.Next() {
+		var tag string
+		err = rows.Scan(&tag)
+		if err != nil {
+			return nil, err
+		}
+
+		tags = append(tags, tag)
+	}
+
+	return tags, rows.Err()
+}
+
+// GetTaggedEntryIds returns the IDs of the entries on a domain with a tag,
+// most recent first.
+func (d *SqliteDatabase) GetTaggedEntryIds(domain, tag string) ([]int, error) {
+	stmt := `
+        SELECT entry_id FROM tags WHERE domain=? AND tag=? ORDER BY entry_id DESC;
+        `
+	rows, err := d.sdb.Query(stmt, domain, tag)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entryIds := []int{}
+
+	for rows.Next() {
+		var entryId int
+		err = rows.Scan(&entryId)
+		if err != nil {
+			return nil, err
+		}
+
+		entryIds = append(entryIds, entryId)
+	}
+
+	return entryIds, rows.Err()
+}
+
+func (d *SqliteDatabase) SetFollower(f *Follower) error {
+	stmt := `
+        INSERT OR REPLACE INTO followers(domain,actor,inbox,shared_inbox,follow_id) VALUES(?,?,?,?,?);
+        `
+	_, err := d.sdb.Exec(stmt, f.Domain, f.Actor, f.Inbox, f.SharedInbox, f.FollowId)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (d *SqliteDatabase) GetFollower(domain, actor string) (*Follower, error) {
+	f := &Follower{}
+
+	stmt := `
+        SELECT domain,actor,inbox,shared_inbox,follow_id FROM followers WHERE domain=? AND actor=?;
+        `
+	err := d.sdb.QueryRow(stmt, domain, actor).Scan(&f.Domain, &f.Actor, &f.Inbox, &f.SharedInbox, &f.FollowId)
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (d *SqliteDatabase) DeleteFollower(domain, actor string) error {
+	stmt := `
+        DELETE FROM followers WHERE domain=? AND actor=?;
+        `
+	_, err := d.sdb.Exec(stmt, domain, actor)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetFollowers returns the followers of a domain, most recent first.
+func (d *SqliteDatabase) GetFollowers(domain string) ([]*Follower, error) {
+	stmt := `
+        SELECT domain,actor,inbox,shared_inbox,follow_id FROM followers WHERE domain=? ORDER BY rowid DESC;
+        `
+	rows, err := d.sdb.Query(stmt, domain)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	followers := []*Follower{}
+
+	for rows.Next() {
+		f := &Follower{}
+		err = rows.Scan(&f.Domain, &f.Actor, &f.Inbox, &f.SharedInbox, &f.FollowId)
+		if err != nil {
+			return nil, err
+		}
+
+		followers = append(followers, f)
+	}
+
+	return followers, rows.Err()
+}
+
+// GetFollowedDomains returns the hosted domains which an actor follows.
+func (d *SqliteDatabase) GetFollowedDomains(actor string) ([]string, error) {
+	stmt := `
+        SELECT domain FROM followers WHERE actor=?;
+        `
+	rows, err := d.sdb.Query(stmt, actor)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	domains := []string{}
+
+	for rows.Next() {
+		var domain string
+		err = rows.Scan(&domain)
+		if err != nil {
+			return nil, err
+		}
+
+		domains = append(domains, domain)
+	}
+
+	return domains, rows.Err()
+}
+
+func (d *SqliteDatabase) SetFollowing(f *Following) error {
+	stmt := `
+        INSERT OR REPLACE INTO following(domain,actor,follow_id,inbox,shared_inbox,status) VALUES(?,?,?,?,?,?);
+        `
+	_, err := d.sdb.Exec(stmt, f.Domain, f.Actor, f.FollowId, f.Inbox, f.SharedInbox, f.Status)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (d *SqliteDatabase) GetFollowing(domain, actor string) (*Following, error) {
+	f := &Following{}
+
+	stmt := `
+        SELECT domain,actor,follow_id,inbox,shared_inbox,status FROM following WHERE domain=? AND actor=?;
+        `
+	err := d.sdb.QueryRow(stmt, domain, actor).Scan(&f.Domain, &f.Actor, &f.FollowId, &f.Inbox, &f.SharedInbox, &f.Status)
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (d *SqliteDatabase) DeleteFollowing(domain, actor string) error {
+	stmt := `
+        DELETE FROM following WHERE domain=? AND actor=?;
+        `
+	_, err := d.sdb.Exec(stmt, domain, actor)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetFollowings returns the actors a domain follows with the given status,
+// most recent first.
+func (d *SqliteDatabase) GetFollowings(domain, status string) ([]*Following, error) {
+	stmt := `
+        SELECT domain,actor,follow_id,inbox,shared_inbox,status FROM following
+        WHERE domain=? AND status=? ORDER BY rowid DESC;
+        `
+	rows, err := d.sdb.Query(stmt, domain, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	followings := []*Following{}
+
+	for rows.Next() {
+		f := &Following{}
+		err = rows.Scan(&f.Domain, &f.Actor, &f.FollowId, &f.Inbox, &f.SharedInbox, &f.Status)
+		if err != nil {
+			return nil, err
+		}
+
+		followings = append(followings, f)
+	}
+
+	return followings, rows.Err()
+}
+
+// GetFollowingDomains returns the hosted domains which follow an actor with
+// the given status.
+func (d *SqliteDatabase) GetFollowingDomains(actor, status string) ([]string, error) {
+	stmt := `
+        SELECT domain FROM following WHERE actor=? AND status=?;
+        `
+	rows, err := d.sdb.Query(stmt, actor, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	domains := []string{}
+
+	for rows.Next() {
+		var domain string
+		err = rows.Scan(&domain)
+		if err != nil {
+			return nil, err
+		}
+
+		domains = append(domains, domain)
+	}
+
+	return domains, rows.Err()
+}
+
+func (d *SqliteDatabase) AddDelivery(dl *Delivery) error {
+	stmt := `
+        INSERT INTO deliveries(domain,activity_id,activity,inbox,attempts,next_attempt,last_error,status) VALUES(?,?,?,?,?,?,?,?);
+        `
+	_, err := d.sdb.Exec(stmt, dl.Domain, dl.ActivityId, dl.Activity, dl.Inbox, dl.Attempts, dl.NextAttempt.Unix(), dl.LastError, dl.Status)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (d *SqliteDatabase) UpdateDelivery(dl *Delivery) error {
+	stmt := `
+        UPDATE deliveries SET attempts=?,next_attempt=?,last_error=?,status=? WHERE id=?;
+        `
+	_, err := d.sdb.Exec(stmt, dl.Attempts, dl.NextAttempt.Unix(), dl.LastError, dl.Status, dl.Id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (d *SqliteDatabase) DeleteDelivery(id int) error {
+	stmt := `
+        DELETE FROM deliveries WHERE id=?;
+        `
+	_, err := d.sdb.Exec(stmt, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetDueDeliveries returns pending deliveries which are scheduled to be
+// attempted at or before the given time.
+func (d *SqliteDatabase) GetDueDeliveries(now time.Time) ([]*Delivery, error) {
+	stmt := `
+        SELECT id,domain,activity_id,activity,inbox,attempts,next_attempt,last_error,status FROM deliveries
+        WHERE status=? AND next_attempt<=? ORDER BY next_attempt;
+        `
+	return d.queryDeliveries(stmt, DeliveryStatusPending, now.Unix())
+}
+
+func (d *SqliteDatabase) GetDeliveries() ([]*Delivery, error) {
+	stmt := `
+        SELECT id,domain,activity_id,activity,inbox,attempts,next_attempt,last_error,status FROM deliveries
+        ORDER BY status, next_attempt;
+        `
+	return d.queryDeliveries(stmt)
+}
+
+func (d *SqliteDatabase) queryDeliveries(stmt string, args ...interface{}) ([]*Delivery, error) {
+	rows, err := d.sdb.Query(stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []*Delivery{}
+
+	for rows.Next() {
+		dl := &Delivery{}
+		var nextAttempt int64
+		err = rows.Scan(&dl.Id, &dl.Domain, &dl.ActivityId, &dl.Activity, &dl.Inbox, &dl.Attempts, &nextAttempt, &dl.LastError, &dl.Status)
+		if err != nil {
+			return nil, err
+		}
+
+		dl.NextAttempt = time.Unix(nextAttempt, 0)
+
+		deliveries = append(deliveries, dl)
+	}
+
+	return deliveries, rows.Err()
+}
+
+func (d *SqliteDatabase) SetInboxDead(inbox string) error {
+	stmt := `
+        INSERT OR REPLACE INTO dead_inboxes(inbox,timestamp) VALUES(?,?);
+        `
+	_, err := d.sdb.Exec(stmt, inbox, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeleteDeadInbox forgets that inbox was dead, along with any failures which
+// might have led to it being marked dead again.
+func (d *SqliteDatabase) DeleteDeadInbox(inbox string) error {
+	stmt := `
+        DELETE FROM dead_inboxes WHERE inbox=?;
+        `
+	_, err := d.sdb.Exec(stmt, inbox)
+	if err != nil {
+		return err
+	}
+
+	stmt = `
+        DELETE FROM failing_inboxes WHERE inbox=?;
+        `
+	_, err = d.sdb.Exec(stmt, inbox)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// AddInboxFailure records that a delivery to inbox failed at time now. It
+// returns when the inbox started failing, which is now unless it has failed
+// since its last successful delivery.
+func (d *SqliteDatabase) AddInboxFailure(inbox string, now time.Time) (time.Time, error) {
+	stmt := `
+        INSERT OR IGNORE INTO failing_inboxes(inbox,since) VALUES(?,?);
+        `
+	_, err := d.sdb.Exec(stmt, inbox, now.Unix())
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	stmt = `
+        SELECT since FROM failing_inboxes WHERE inbox=?;
+        `
+	var since int64
+	err = d.sdb.QueryRow(stmt, inbox).Scan(&since)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Unix(since, 0), nil
+}
+
+func (d *SqliteDatabase) IsInboxDead(inbox string) (bool, error) {
+	stmt := `
+        SELECT COUNT(*) FROM dead_inboxes WHERE inbox=?;
+        `
+	var count int
+	err := d.sdb.QueryRow(stmt, inbox).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+// SetReply stores a reply, or replaces it if it's from the same actor. Replies
+// from other actors with the same ID are left alone.
+func (d *SqliteDatabase) SetReply(r *Reply) error {
+	stmt := `
+        INSERT INTO replies(domain,entry_id,id,in_reply_to,actor,object,published) VALUES(?,?,?,?,?,?,?)
+        ON CONFLICT(id) DO UPDATE SET
+                domain=excluded.domain,
+                entry_id=excluded.entry_id,
+                in_reply_to=excluded.in_reply_to,
+                object=excluded.object,
+                published=excluded.published
+        WHERE replies.actor=excluded.actor;
+        `
+	_, err := d.sdb.Exec(stmt, r.Domain, r.EntryId, r.Id, r.InReplyTo, r.Actor, r.Object, r.Published.Unix())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (d *SqliteDatabase) GetReply(id string) (*Reply, error) {
+	stmt := `
+        SELECT domain,entry_id,id,in_reply_to,actor,object,published FROM replies WHERE id=?;
+        `
+	replies, err := d.queryReplies(stmt, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(replies) == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	return replies[0], nil
+}
+
+// GetReplies returns all the replies in the thread below an entry, including
+// replies to other replies, oldest first.
+func (d *SqliteDatabase) GetReplies(domain string, entryId int) ([]*Reply, error) {
+	stmt := `
+        SELECT domain,entry_id,id,in_reply_to,actor,object,published FROM replies
+        WHERE domain=? AND entry_id=? ORDER BY published;
+        `
+	return d.queryReplies(stmt, domain, entryId)
+}
+
+func (d *SqliteDatabase) DeleteReply(id string) error {
+	stmt := `
+        DELETE FROM replies WHERE id=?;
+        `
+	_, err := d.sdb.Exec(stmt, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (d *SqliteDatabase) DeleteRepliesByActor(actor string) error {
+	stmt := `
+        DELETE FROM replies WHERE actor=?;
+        `
+	_, err := d.sdb.Exec(stmt, actor)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (d *SqliteDatabase) queryReplies(stmt string, args ...interface{}) ([]*Reply, error) {
+	rows, err := d.sdb.Query(stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	replies := []*Reply{}
+
+	for rows.Next() {
+		r := &Reply{}
+		var published int64
+		err = rows.Scan(&r.Domain, &r.EntryId, &r.Id, &r.InReplyTo, &r.Actor, &r.Object, &published)
+		if err != nil {
+			return nil, err
+		}
+
+		r.Published = time.Unix(published, 0)
+
+		replies = append(replies, r)
+	}
+
+	return replies, rows.Err()
+}
+
+// SetReaction stores a reaction, or replaces it if it's from the same actor.
+// Reactions from other actors with the same ID are left alone.
+func (d *SqliteDatabase) SetReaction(r *Reaction) error {
+	stmt := `
+        INSERT INTO reactions(domain,entry_id,type,id,actor,actor_name,actor_icon,published) VALUES(?,?,?,?,?,?,?,?)
+        ON CONFLICT(id) DO UPDATE SET
+                domain=excluded.domain,
+                entry_id=excluded.entry_id,
+                type=excluded.type,
+                actor_name=excluded.actor_name,
+                actor_icon=excluded.actor_icon,
+                published=excluded.published
+        WHERE reactions.actor=excluded.actor;
+        `
+	_, err := d.sdb.Exec(stmt, r.Domain, r.EntryId, r.Type, r.Id, r.Actor, r.ActorName, r.ActorIcon, r.Published.Unix())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeleteReaction removes a reaction, as long as it belongs to the given
+// actor.
+func (d *SqliteDatabase) DeleteReaction(id, actor string) error {
+	stmt := `
+        DELETE FROM reactions WHERE id=? AND actor=?;
+        `
+	_, err := d.sdb.Exec(stmt, id, actor)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (d *SqliteDatabase) DeleteReactionsByActor(actor string) error {
+	stmt := `
+        DELETE FROM reactions WHERE actor=?;
+        `
+	_, err := d.sdb.Exec(stmt, actor)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// UpdateReactionActor refreshes the actor details stored alongside all of an
+// actor's reactions.
+func (d *SqliteDatabase) UpdateReactionActor(actor, actorName, actorIcon string) error {
+	stmt := `
+        UPDATE reactions SET actor_name=?,actor_icon=? WHERE actor=?;
+        `
+	_, err := d.sdb.Exec(stmt, actorName, actorIcon, actor)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (d *SqliteDatabase) GetReaction(id string) (*Reaction, error) {
+	r := &Reaction{}
+	var published int64
+
+	stmt := `
+        SELECT domain,entry_id,type,id,actor,actor_name,actor_icon,published FROM reactions WHERE id=?;
+        `
+	err := d.sdb.QueryRow(stmt, id).Scan(&r.Domain, &r.EntryId, &r.Type, &r.Id, &r.Actor, &r.ActorName, &r.ActorIcon, &published)
+	if err != nil {
+		return nil, err
+	}
+
+	r.Published = time.Unix(published, 0)
+
+	return r, nil
+}
+
+func (d *SqliteDatabase) GetReactions(domain string, entryId int, reactionType string) ([]*Reaction, error) {
+	stmt := `
+        SELECT domain,entry_id,type,id,actor,actor_name,actor_icon,published FROM reactions
+        WHERE domain=? AND entry_id=? AND type=? ORDER BY published;
+        `
+	rows, err := d.sdb.Query(stmt, domain, entryId, reactionType)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reactions := []*Reaction{}
+
+	for rows.Next() {
+		r := &Reaction{}
+		var published int64
+		err = rows.Scan(&r.Domain, &r.EntryId, &r.Type, &r.Id, &r.Actor, &r.ActorName, &r.ActorIcon, &published)
+		if err != nil {
+			return nil, err
+		}
+
+		r.Published = time.Unix(published, 0)
+
+		reactions = append(reactions, r)
+	}
+
+	return reactions, rows.Err()
+}
+
+func (d *SqliteDatabase) SetTimelineItem(t *TimelineItem) error {
+	stmt := `
+        INSERT OR REPLACE INTO timeline(domain,id,actor,actor_name,actor_icon,object,published) VALUES(?,?,?,?,?,?,?);
+        `
+	_, err := d.sdb.Exec(stmt, t.Domain, t.Id, t.Actor, t.ActorName, t.ActorIcon, t.Object, t.Published.Unix())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetTimeline returns the most recent posts in a domain's timeline, newest
+// first.
+func (d *SqliteDatabase) GetTimeline(domain string, limit int) ([]*TimelineItem, error) {
+	stmt := `
+        SELECT domain,id,actor,actor_name,actor_icon,object,published FROM timeline
+        WHERE domain=? ORDER BY published DESC LIMIT ?;
+        `
+	return d.queryTimeline(stmt, domain, limit)
+}
+
+// GetTimelineItems returns every stored copy of a post, since it can be in
+// the timelines of several domains.
+func (d *SqliteDatabase) GetTimelineItems(id string) ([]*TimelineItem, error) {
+	stmt := `
+        SELECT domain,id,actor,actor_name,actor_icon,object,published FROM timeline
+        WHERE id=?;
+        `
+	return d.queryTimeline(stmt, id)
+}
+
+// DeleteTimelineItem removes a post from all timelines, as long as it belongs
+// to the given actor.
+func (d *SqliteDatabase) DeleteTimelineItem(id, actor string) error {
+	stmt := `
+        DELETE FROM timeline WHERE id=? AND actor=?;
+        `
+	_, err := d.sdb.Exec(stmt, id, actor)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (d *SqliteDatabase) DeleteTimelineItemsByActor(actor string) error {
+	stmt := `
+        DELETE FROM timeline WHERE actor=?;
+        `
+	_, err := d.sdb.Exec(stmt, actor)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (d *SqliteDatabase) queryTimeline(stmt string, args ...interface{}) ([]*TimelineItem, error) {
+	rows, err := d.sdb.Query(stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []*TimelineItem{}
+
+	for rows.Next() {
+		t := &TimelineItem{}
+		var published int64
+		err = rows.Scan(&t.Domain, &t.Id, &t.Actor, &t.ActorName, &t.ActorIcon, &t.Object, &published)
+		if err != nil {
+			return nil, err
+		}
+
+		t.Published = time.Unix(published, 0)
+
+		items = append(items, t)
+	}
+
+	return items, rows.Err()
+}
+
+// IsBlocked checks whether domain blocks an actor, either directly or by
+// blocking the domain it's on. Blocking a domain covers its subdomains too.
+func (d *SqliteDatabase) IsBlocked(domain, actor string) (bool, error) {
+
+	parsedActor, err := url.Parse(actor)
+	if err != nil {
+		return false, err
+	}
+
+	targets := []interface{}{actor}
+
+	host := parsedActor.Hostname()
+	for host != "" {
+		targets = append(targets, host)
+
+		_, parent, found := strings.Cut(host, ".")
+		if !found {
+			break
+		}
+		host = parent
+	}
+
+	stmt := fmt.Sprintf(`
+        SELECT COUNT(*) FROM blocks WHERE domain=? AND target IN (?%s);
+        `, strings.Repeat(",?", len(targets)-1))
+
+	var numBlocks int
+	err = d.sdb.QueryRow(stmt, append([]interface{}{domain}, targets...)...).Scan(&numBlocks)
+	if err != nil {
+		return false, err
+	}
+
+	return numBlocks > 0, nil
+}
+
+func (d *SqliteDatabase) SetBlock(b *Block) error {
+	stmt := `
+        INSERT OR REPLACE INTO blocks(domain,target,created) VALUES(?,?,?);
+        `
+	_, err := d.sdb.Exec(stmt, b.Domain, b.Target, b.Created.Unix())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (d *SqliteDatabase) DeleteBlock(domain, target string) error {
+	stmt := `
+        DELETE FROM blocks WHERE domain=? AND target=?;
+        `
+	_, err := d.sdb.Exec(stmt, domain, target)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetBlocks returns everything a domain blocks, most recent first.
+func (d *SqliteDatabase) GetBlocks(domain string) ([]*Block, error) {
+	stmt := `
+        SELECT domain,target,created FROM blocks WHERE domain=? ORDER BY created DESC;
+        `
+	rows, err := d.sdb.Query(stmt, domain)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	blocks := []*Block{}
+
+	for rows.Next() {
+		b := &Block{}
+		var created int64
+		err = rows.Scan(&b.Domain, &b.Target, &created)
+		if err != nil {
+			return nil, err
+		}
+
+		b.Created = time.Unix(created, 0)
+
+		blocks = append(blocks, b)
+	}
+
+	return blocks, rows.Err()
+}
+
+func (d *SqliteDatabase) SetFollowRequest(f *FollowRequest) error {
+	stmt := `
+        INSERT OR REPLACE INTO follow_requests(domain,actor,actor_name,actor_icon,activity,created) VALUES(?,?,?,?,?,?);
+        `
+	_, err := d.sdb.Exec(stmt, f.Domain, f.Actor, f.ActorName, f.ActorIcon, f.Activity, f.Created.Unix())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (d *SqliteDatabase) GetFollowRequest(domain, actor string) (*FollowRequest, error) {
+	stmt := `
+        SELECT domain,actor,actor_name,actor_icon,activity,created FROM follow_requests WHERE domain=? AND actor=?;
+        `
+	requests, err := d.queryFollowRequests(stmt, domain, actor)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(requests) == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	return requests[0], nil
+}
+
+func (d *SqliteDatabase) DeleteFollowRequest(domain, actor string) error {
+	stmt := `
+        DELETE FROM follow_requests WHERE domain=? AND actor=?;
+        `
+	_, err := d.sdb.Exec(stmt, domain, actor)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (d *SqliteDatabase) DeleteFollowRequestsByActor(actor string) error {
+	stmt := `
+        DELETE FROM follow_requests WHERE actor=?;
+        `
+	_, err := d.sdb.Exec(stmt, actor)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetFollowRequestDomains returns the hosted domains which an actor is
+// waiting to be approved by.
+func (d *SqliteDatabase) GetFollowRequestDomains(actor string) ([]string, error) {
+	stmt := `
+        SELECT domain FROM follow_requests WHERE actor=?;
+        `
+	rows, err := d.sdb.Query(stmt, actor)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	domains := []string{}
+
+	for rows.Next() {
+		var domain string
+		err = rows.Scan(&domain)
+		if err != nil {
+			return nil, err
+		}
+
+		domains = append(domains, domain)
+	}
+
+	return domains, rows.Err()
+}
+
+// GetFollowRequests returns the Follows waiting for approval on a domain,
+// oldest first.
+func (d *SqliteDatabase) GetFollowRequests(domain string) ([]*FollowRequest, error) {
+	stmt := `
+        SELECT domain,actor,actor_name,actor_icon,activity,created FROM follow_requests WHERE domain=? ORDER BY created;
+        `
+	return d.queryFollowRequests(stmt, domain)
+}
+
+func (d *SqliteDatabase) queryFollowRequests(stmt string, args ...interface{}) ([]*FollowRequest, error) {
+
+	rows, err := d.sdb.Query(stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	requests := []*FollowRequest{}
+
+	for rows.Next() {
+		f := &FollowRequest{}
+		var created int64
+		err = rows.Scan(&f.Domain, &f.Actor, &f.ActorName, &f.ActorIcon, &f.Activity, &created)
+		if err != nil {
+			return nil, err
+		}
+
+		f.Created = time.Unix(created, 0)
+
+		requests = append(requests, f)
+	}
+
+	return requests, rows.Err()
+}
@@ -0,0 +1,246 @@
+package syndicat
+
+import (
+	"context"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/go-ap/activitypub"
+	"github.com/go-ap/jsonld"
+)
+
+const (
+	DeliveryStatusPending = "pending"
+	DeliveryStatusFailed  = "failed"
+)
+
+const maxDeliveryAttempts = 12
+const deadInboxAfter = 7 * 24 * time.Hour
+const deliveryBaseDelay = time.Minute
+const deliveryPollInterval = 10 * time.Second
+const deliveryConcurrency = 8
+
+// DeliveryQueue persists outgoing activities in the database and delivers
+// them in the background, retrying failures with exponential backoff up to
+// maxDeliveryAttempts times. Activities which the inbox rejects outright
+// aren't retried. An inbox which has failed every delivery for
+// deadInboxAfter is marked dead, and only gets one attempt at each activity
+// until a delivery to it succeeds again. Each delivery is signed with the
+// key of the domain which sent it.
+type DeliveryQueue struct {
+	db         *SqliteDatabase
+	httpClient *http.Client
+	sourceDir  string
+	rootUri    string
+	notify     chan struct{}
+	keysMut    sync.Mutex
+	privKeys   map[string]*rsa.PrivateKey
+}
+
+func NewDeliveryQueue(db *SqliteDatabase, httpClient *http.Client, sourceDir, rootUri string) *DeliveryQueue {
+	return &DeliveryQueue{
+		db:         db,
+		httpClient: httpClient,
+		sourceDir:  sourceDir,
+		rootUri:    rootUri,
+		notify:     make(chan struct{}, 1),
+		privKeys:   make(map[string]*rsa.PrivateKey),
+	}
+}
+
+// Enqueue queues activity for delivery to each inbox, signed as domain.
+func (q *DeliveryQueue) Enqueue(domain string, activity *activitypub.Activity, inboxes []string) error {
+
+	activityJsonBytes, err := jsonld.WithContext(
+		jsonld.IRI(activitypub.ActivityBaseURI),
+	).Marshal(activity)
+	if err != nil {
+		return err
+	}
+
+	for _, inbox := range inboxes {
+
+		delivery := &Delivery{
+			Domain:      domain,
+			ActivityId:  string(activity.ID),
+			Activity:    string(activityJsonBytes),
+			Inbox:       inbox,
+			NextAttempt: time.Now(),
+			Status:      DeliveryStatusPending,
+		}
+
+		err = q.db.AddDelivery(delivery)
+		if err != nil {
+			return err
+		}
+	}
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// Run processes deliveries until ctx is canceled. Deliveries which are in
+// flight when that happens are allowed to finish, and the rest stay queued.
+func (q *DeliveryQueue) Run(ctx context.Context) {
+
+	ticker := time.NewTicker(deliveryPollInterval)
+	defer ticker.Stop()
+
+	for {
+		err := q.processDue(ctx)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-q.notify:
+		}
+	}
+}
+
+func (q *DeliveryQueue) processDue(ctx context.Context) error {
+
+	deliveries, err := q.db.GetDueDeliveries(time.Now())
+	if err != nil {
+		return err
+	}
+
+	sem := make(chan struct{}, deliveryConcurrency)
+	wg := sync.WaitGroup{}
+
+	for _, delivery := range deliveries {
+		sem <- struct{}{}
+
+		if ctx.Err() != nil {
+			<-sem
+			break
+		}
+
+		wg.Add(1)
+		go func(delivery *Delivery) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			err := q.attempt(delivery)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err.Error())
+			}
+		}(delivery)
+	}
+
+	wg.Wait()
+
+	return nil
+}
+
+func (q *DeliveryQueue) attempt(delivery *Delivery) error {
+
+	// Without the sender's key there's nothing to retry, and it's no fault
+	// of the inbox
+	privKey, pubKeyId, err := q.getKey(delivery.Domain)
+	if err != nil {
+		delivery.Status = DeliveryStatusFailed
+		delivery.LastError = err.Error()
+		return q.db.UpdateDelivery(delivery)
+	}
+
+	dead, err := q.db.IsInboxDead(delivery.Inbox)
+	if err != nil {
+		return err
+	}
+
+	err = postActivity(q.httpClient, privKey, pubKeyId, []byte(delivery.Activity), delivery.Inbox)
+	if err == nil {
+		err = q.db.DeleteDeadInbox(delivery.Inbox)
+		if err != nil {
+			return err
+		}
+
+		return q.db.DeleteDelivery(delivery.Id)
+	}
+
+	fmt.Fprintf(os.Stderr, "Failed to deliver %s to %s: %s\n", delivery.ActivityId, delivery.Inbox, err.Error())
+
+	delivery.Attempts += 1
+	delivery.LastError = err.Error()
+
+	// The inbox is up but refuses this activity, which says nothing about
+	// the deliveries to it
+	var postErr *postError
+	if errors.As(err, &postErr) && postErr.isPermanent() {
+		delivery.Status = DeliveryStatusFailed
+		return q.db.UpdateDelivery(delivery)
+	}
+
+	now := time.Now()
+
+	failingSince, err := q.db.AddInboxFailure(delivery.Inbox, now)
+	if err != nil {
+		return err
+	}
+
+	if !dead && now.Sub(failingSince) >= deadInboxAfter {
+		dead = true
+
+		err = q.db.SetInboxDead(delivery.Inbox)
+		if err != nil {
+			return err
+		}
+	}
+
+	if dead || delivery.Attempts >= maxDeliveryAttempts {
+		delivery.Status = DeliveryStatusFailed
+	} else {
+		backoff := deliveryBaseDelay * time.Duration(1<<(delivery.Attempts-1))
+		delivery.NextAttempt = now.Add(backoff)
+	}
+
+	return q.db.UpdateDelivery(delivery)
+}
+
+// getKey returns the private key of domain and the ID of its public key,
+// loading the key from the domain's directory the first time it's needed.
+func (q *DeliveryQueue) getKey(domain string) (*rsa.PrivateKey, string, error) {
+
+	if domain == "" {
+		domain = q.rootUri
+	}
+
+	pubKeyId := fmt.Sprintf("https://%s/ap.jsonld#main-key", domain)
+
+	q.keysMut.Lock()
+	defer q.keysMut.Unlock()
+
+	privKey, exists := q.privKeys[domain]
+	if exists {
+		return privKey, pubKeyId, nil
+	}
+
+	if !isHostedDomain(q.sourceDir, domain) {
+		return nil, "", fmt.Errorf("%s is not a hosted domain", domain)
+	}
+
+	privKey, err := LoadRSAKey(filepath.Join(q.sourceDir, domain, "private_key.pem"))
+	if err != nil {
+		return nil, "", err
+	}
+
+	q.privKeys[domain] = privKey
+
+	return privKey, pubKeyId, nil
+}
@@ -0,0 +1,160 @@
+package syndicat
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-ap/activitypub"
+	"github.com/go-ap/jsonld"
+)
+
+// readEntryActivity loads the Create activity for an entry, which is what
+// entries are rendered from, along with the entry itself.
+func readEntryActivity(entryDir string) (*activitypub.Activity, *activitypub.Object, error) {
+
+	activityBytes, err := os.ReadFile(filepath.Join(entryDir, "activity.jsonld"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var activityItem *activitypub.Activity
+	err = json.Unmarshal(activityBytes, &activityItem)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	activity, err := activitypub.ToActivity(activityItem)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	entry, err := activitypub.ToObject(activity.Object)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = loadHashtags(activityBytes, entry)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return activity, entry, nil
+}
+
+func writeEntryActivity(entryDir string, activity *activitypub.Activity, entry *activitypub.Object) error {
+
+	activity.Object = entry
+
+	activityJsonBytes, err := jsonld.WithContext(
+		jsonld.IRI(activitypub.ActivityBaseURI),
+	).Marshal(activity)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(filepath.Join(entryDir, "activity.jsonld"), activityJsonBytes, 0644)
+	if err != nil {
+		return err
+	}
+
+	return writeObject(filepath.Join(entryDir, "entry.jsonld"), entry)
+}
+
+// deleteEntry replaces an entry with a Tombstone. The entry directory is kept
+// so the ID isn't reused and we can keep answering with 410 Gone.
+func deleteEntry(sourceDir, serveDir, domain string, entryId int, entry *activitypub.Object) (*activitypub.Tombstone, error) {
+
+	entryIdStr := strconv.Itoa(entryId)
+
+	tombstone := &activitypub.Tombstone{
+		ID:         entry.ID,
+		Type:       activitypub.TombstoneType,
+		FormerType: entry.Type,
+		Deleted:    time.Now(),
+	}
+
+	err := os.Remove(filepath.Join(sourceDir, domain, entryIdStr, "activity.jsonld"))
+	if err != nil {
+		return nil, err
+	}
+
+	entryRenderDir := filepath.Join(serveDir, domain, entryIdStr)
+
+	for _, name := range []string{"index.html", "replies.jsonld", "likes.jsonld", "shares.jsonld"} {
+		err = os.Remove(filepath.Join(entryRenderDir, name))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	err = os.RemoveAll(filepath.Join(entryRenderDir, "edit"))
+	if err != nil {
+		return nil, err
+	}
+
+	tombstoneBytes, err := jsonld.WithContext(
+		jsonld.IRI(activitypub.ActivityBaseURI),
+	).Marshal(tombstone)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.WriteFile(filepath.Join(entryRenderDir, "entry.jsonld"), tombstoneBytes, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return tombstone, nil
+}
+
+// getEntryPage splits a request path under an entry into the entry ID and
+// the page being asked for, which is "" for the entry itself and "edit" for
+// its editor.
+func getEntryPage(reqPath string) (int, string, bool) {
+
+	parts := strings.Split(strings.Trim(reqPath, "/"), "/")
+
+	entryId, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, "", false
+	}
+
+	page := strings.TrimSuffix(strings.Join(parts[1:], "/"), "index.html")
+
+	return entryId, strings.Trim(page, "/"), true
+}
+
+// getTombstone returns the Tombstone JSON for the entry which reqPath is
+// part of, if that entry has been deleted.
+func getTombstone(serveDir, domain, reqPath string) ([]byte, bool) {
+
+	entryIdStr := strings.Split(strings.Trim(reqPath, "/"), "/")[0]
+
+	_, err := strconv.Atoi(entryIdStr)
+	if err != nil {
+		return nil, false
+	}
+
+	entryPath := filepath.Join(serveDir, domain, entryIdStr, "entry.jsonld")
+
+	entryBytes, err := os.ReadFile(entryPath)
+	if err != nil {
+		return nil, false
+	}
+
+	var obj *activitypub.Object
+	err = json.Unmarshal(entryBytes, &obj)
+	if err != nil {
+		return nil, false
+	}
+
+	if obj.Type != activitypub.TombstoneType {
+		return nil, false
+	}
+
+	return entryBytes, true
+}
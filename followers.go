@@ -0,0 +1,335 @@
+package syndicat
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-ap/activitypub"
+	"github.com/go-ap/client"
+	"github.com/go-ap/jsonld"
+)
+
+func readOrderedCollection(path string) (*activitypub.OrderedCollection, error) {
+
+	collectionBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var collection *activitypub.OrderedCollection
+	err = json.Unmarshal(collectionBytes, &collection)
+	if err != nil {
+		return nil, err
+	}
+
+	return collection, nil
+}
+
+func writeOrderedCollection(path string, collection *activitypub.OrderedCollection) error {
+
+	collectionBytes, err := jsonld.WithContext(
+		jsonld.IRI(activitypub.ActivityBaseURI),
+	).Marshal(collection)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, collectionBytes)
+}
+
+func writeObject(path string, obj *activitypub.Object) error {
+
+	objBytes, err := jsonld.WithContext(
+		jsonld.IRI(activitypub.ActivityBaseURI),
+	).Marshal(obj)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, objBytes, 0644)
+}
+
+func writeOrderedCollectionPage(path string, page *activitypub.OrderedCollectionPage) error {
+
+	pageBytes, err := jsonld.WithContext(
+		jsonld.IRI(activitypub.ActivityBaseURI),
+	).Marshal(page)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, pageBytes)
+}
+
+// writeFollowersCollection publishes the followers of a domain from the
+// database, which is the source of truth for followers.
+func writeFollowersCollection(db *SqliteDatabase, userServeDir, domain string) error {
+
+	followers, err := db.GetFollowers(domain)
+	if err != nil {
+		return err
+	}
+
+	items := activitypub.ItemCollection{}
+
+	for _, follower := range followers {
+		items = append(items, activitypub.IRI(follower.Actor))
+	}
+
+	return writePagedCollection(userServeDir, domain, "followers", items)
+}
+
+// addFollower records a follower in the database, which also keeps track of
+// their inboxes, and republishes the followers collection.
+func addFollower(db *SqliteDatabase, serveDir string, follower *Follower) error {
+
+	err := db.SetFollower(follower)
+	if err != nil {
+		return err
+	}
+
+	userServeDir := filepath.Join(serveDir, follower.Domain)
+
+	return writeFollowersCollection(db, userServeDir, follower.Domain)
+}
+
+// acceptFollow adds the sender of a Follow of domain as a follower, and
+// returns the Accept to send them along with their inbox.
+func acceptFollow(db *SqliteDatabase, apClient *client.C, serveDir, domain string, follow *activitypub.Activity) (*activitypub.Activity, string, error) {
+
+	// TODO: using GetID() because it was panicking with a weird error when type asserting
+	// act.Actor.(activitypub.IRI)
+	newFollower := follow.Actor.GetID()
+
+	follower, err := getFollower(apClient, domain, newFollower)
+	if err != nil {
+		return nil, "", err
+	}
+
+	follower.FollowId = string(follow.ID)
+
+	err = addFollower(db, serveDir, follower)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// They just reached us, so they're clearly not dead
+	for _, inbox := range []string{follower.Inbox, follower.SharedInbox} {
+		err = db.DeleteDeadInbox(inbox)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	actorId := activitypub.IRI(fmt.Sprintf("https://%s/ap.jsonld", domain))
+	acceptId := activitypub.IRI(fmt.Sprintf("%s#accepts/follows/%d", actorId, time.Now().UnixNano()))
+	accept := &activitypub.Accept{
+		ID:     acceptId,
+		Type:   activitypub.AcceptType,
+		Actor:  actorId,
+		Object: follow,
+	}
+
+	// We're only replying to this one actor, so their personal inbox
+	// is preferred over the shared one
+	inbox := follower.Inbox
+	if inbox == "" {
+		inbox = follower.SharedInbox
+	}
+
+	return accept, inbox, nil
+}
+
+// addFollowRequest holds on to a Follow of domain until it's approved or
+// rejected, for profiles that approve followers manually.
+func addFollowRequest(db *SqliteDatabase, apClient *client.C, domain string, follow *activitypub.Activity) error {
+
+	actor, err := getActor(apClient, follow.Actor.GetID())
+	if err != nil {
+		return err
+	}
+
+	followJson, err := jsonld.WithContext(
+		jsonld.IRI(activitypub.ActivityBaseURI),
+	).Marshal(follow)
+	if err != nil {
+		return err
+	}
+
+	return db.SetFollowRequest(&FollowRequest{
+		Domain:    domain,
+		Actor:     string(actor.ID),
+		ActorName: getActorName(actor),
+		ActorIcon: getActorIcon(actor),
+		Activity:  string(followJson),
+		Created:   time.Now(),
+	})
+}
+
+// decideFollowRequest approves or rejects the pending Follow of domain from
+// actorId, and returns the Accept or Reject to send along with the inbox it
+// goes to.
+func decideFollowRequest(db *SqliteDatabase, apClient *client.C, serveDir, domain, actorId string, approve bool) (*activitypub.Activity, string, error) {
+
+	request, err := db.GetFollowRequest(domain, actorId)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var follow *activitypub.Activity
+	err = json.Unmarshal([]byte(request.Activity), &follow)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var answer *activitypub.Activity
+	var inbox string
+	if approve {
+		answer, inbox, err = acceptFollow(db, apClient, serveDir, domain, follow)
+	} else {
+		answer, inbox, err = rejectFollow(apClient, domain, follow)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	err = db.DeleteFollowRequest(domain, actorId)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return answer, inbox, nil
+}
+
+func removeFollower(db *SqliteDatabase, serveDir, domain string, actorId activitypub.IRI) error {
+
+	err := db.DeleteFollower(domain, string(actorId))
+	if err != nil {
+		return err
+	}
+
+	userServeDir := filepath.Join(serveDir, domain)
+
+	return writeFollowersCollection(db, userServeDir, domain)
+}
+
+// importLegacyFollowers copies followers from followers.jsonld files written
+// before followers were kept in the database. Those files list every
+// follower inline, whereas current ones only link to pages. Only the actor
+// IDs are imported, so this doesn't have to wait on remote servers, and
+// resolveFollowerInboxes fills in the inboxes when they're needed.
+func importLegacyFollowers(db *SqliteDatabase, serveDir string) error {
+
+	dirItems, err := os.ReadDir(serveDir)
+	if err != nil {
+		return err
+	}
+
+	for _, item := range dirItems {
+		if !item.IsDir() {
+			continue
+		}
+
+		domain := item.Name()
+
+		followers, err := readOrderedCollection(filepath.Join(serveDir, domain, "followers.jsonld"))
+		if err != nil {
+			continue
+		}
+
+		for _, f := range followers.OrderedItems {
+
+			actorId := f.GetLink()
+
+			_, err := db.GetFollower(domain, string(actorId))
+			if err == nil {
+				continue
+			}
+
+			err = db.SetFollower(&Follower{
+				Domain: domain,
+				Actor:  string(actorId),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// resolveFollowerInboxes looks up the inboxes of followers we don't have
+// them for yet, ie those imported from legacy followers.jsonld files.
+// Followers which can't be resolved right now are left out, and tried again
+// next time.
+func resolveFollowerInboxes(db *SqliteDatabase, apClient *client.C, followers []*Follower) ([]*Follower, error) {
+
+	resolved := []*Follower{}
+
+	for _, follower := range followers {
+		if follower.Inbox != "" || follower.SharedInbox != "" {
+			resolved = append(resolved, follower)
+			continue
+		}
+
+		fetched, err := getFollower(apClient, follower.Domain, activitypub.IRI(follower.Actor))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to resolve follower %s: %s\n", follower.Actor, err.Error())
+			continue
+		}
+
+		fetched.FollowId = follower.FollowId
+
+		err = db.SetFollower(fetched)
+		if err != nil {
+			return nil, err
+		}
+
+		resolved = append(resolved, fetched)
+	}
+
+	return resolved, nil
+}
+
+// purgeActor removes everything we've stored from an actor, after they've
+// been deleted on their server.
+func purgeActor(db *SqliteDatabase, serveDir string, actorId activitypub.IRI) error {
+
+	err := db.DeleteRepliesByActor(string(actorId))
+	if err != nil {
+		return err
+	}
+
+	err = db.DeleteReactionsByActor(string(actorId))
+	if err != nil {
+		return err
+	}
+
+	err = db.DeleteTimelineItemsByActor(string(actorId))
+	if err != nil {
+		return err
+	}
+
+	domains, err := db.GetFollowedDomains(string(actorId))
+	if err != nil {
+		return err
+	}
+
+	for _, domain := range domains {
+		err = removeFollower(db, serveDir, domain, actorId)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = db.DeleteFollowRequestsByActor(string(actorId))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
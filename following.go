@@ -0,0 +1,169 @@
+package syndicat
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-ap/activitypub"
+	"github.com/go-ap/client"
+)
+
+// resolveHandle looks up the actor ID for a handle such as @user@example.com
+// using WebFinger. Actor URIs are returned as is.
+func resolveHandle(httpClient *http.Client, handle string) (activitypub.IRI, error) {
+
+	handle = strings.TrimSpace(handle)
+
+	if isHttpUrl(handle) {
+		return activitypub.IRI(handle), nil
+	}
+
+	handle = strings.TrimPrefix(handle, "@")
+	handle = strings.TrimPrefix(handle, "acct:")
+
+	parts := strings.Split(handle, "@")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", fmt.Errorf("Invalid handle %s", handle)
+	}
+
+	wfUri := fmt.Sprintf("https://%s/.well-known/webfinger?resource=%s", parts[1], url.QueryEscape("acct:"+handle))
+
+	req, err := http.NewRequest("GET", wfUri, nil)
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("Accept", "application/jrd+json")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("WebFinger for %s returned %d", handle, resp.StatusCode)
+	}
+
+	var account *WebFingerAccount
+	err = json.NewDecoder(resp.Body).Decode(&account)
+	if err != nil {
+		return "", err
+	}
+
+	for _, link := range account.Links {
+		if link.Rel != "self" {
+			continue
+		}
+
+		if link.Type == "application/activity+json" || strings.HasPrefix(link.Type, "application/ld+json") {
+			return activitypub.IRI(link.Href), nil
+		}
+	}
+
+	return "", fmt.Errorf("No ActivityPub actor found for %s", handle)
+}
+
+// follow records a pending follow of a remote actor and returns the Follow
+// activity, along with the inbox it needs to be delivered to.
+func follow(db *SqliteDatabase, apClient *client.C, domain string, actorId activitypub.IRI) (*activitypub.Activity, string, error) {
+
+	actor, err := getActor(apClient, actorId)
+	if err != nil {
+		return nil, "", err
+	}
+
+	ourActorId := activitypub.IRI(fmt.Sprintf("https://%s/ap.jsonld", domain))
+	followId := activitypub.IRI(fmt.Sprintf("%s#follows/%d", ourActorId, time.Now().UnixNano()))
+
+	followAct := activitypub.ActivityNew(followId, activitypub.FollowType, actor.ID)
+	followAct.Actor = ourActorId
+	followAct.To = activitypub.ItemCollection{
+		actor.ID,
+	}
+
+	following := &Following{
+		Domain:   domain,
+		Actor:    string(actor.ID),
+		FollowId: string(followId),
+		Status:   FollowingStatusPending,
+	}
+
+	if actor.Inbox != nil {
+		following.Inbox = string(actor.Inbox.GetLink())
+	}
+
+	if actor.Endpoints != nil && actor.Endpoints.SharedInbox != nil {
+		following.SharedInbox = string(actor.Endpoints.SharedInbox.GetLink())
+	}
+
+	if following.Inbox == "" {
+		return nil, "", fmt.Errorf("actor %s has no inbox", actor.ID)
+	}
+
+	err = db.SetFollowing(following)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return followAct, following.Inbox, nil
+}
+
+// answerFollow handles an Accept or Reject of one of our follows. It returns
+// false if we never asked to follow the sender.
+func answerFollow(db *SqliteDatabase, serveDir, domain string, act *activitypub.Activity) (bool, error) {
+
+	// The object should be our Follow, either embedded or by ID
+	if act.Object != nil && !activitypub.IsIRI(act.Object) && act.Object.GetType() != activitypub.FollowType {
+		return false, nil
+	}
+
+	following, err := db.GetFollowing(domain, string(act.Actor.GetID()))
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	switch act.Type {
+	case activitypub.AcceptType:
+		following.Status = FollowingStatusAccepted
+		err = db.SetFollowing(following)
+	case activitypub.RejectType:
+		err = db.DeleteFollowing(domain, following.Actor)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	err = writeFollowingCollection(db, filepath.Join(serveDir, domain), domain)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func writeFollowingCollection(db *SqliteDatabase, userServeDir, domain string) error {
+
+	followings, err := db.GetFollowings(domain, FollowingStatusAccepted)
+	if err != nil {
+		return err
+	}
+
+	items := activitypub.ItemCollection{}
+
+	for _, following := range followings {
+		items = append(items, activitypub.IRI(following.Actor))
+	}
+
+	return writePagedCollection(userServeDir, domain, "following", items)
+}
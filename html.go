@@ -0,0 +1,177 @@
+package syndicat
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// Tags which are allowed in remote content, along with the attributes each
+// is allowed to keep. This covers what Mastodon and friends send.
+var allowedHtmlTags = map[string][]string{
+	"a":          []string{"href", "class", "rel"},
+	"span":       []string{"class"},
+	"p":          nil,
+	"br":         nil,
+	"em":         nil,
+	"strong":     nil,
+	"b":          nil,
+	"i":          nil,
+	"u":          nil,
+	"del":        nil,
+	"code":       nil,
+	"pre":        nil,
+	"blockquote": nil,
+	"ul":         nil,
+	"ol":         nil,
+	"li":         nil,
+}
+
+// sanitizeHtml strips everything from remote HTML except a small set of
+// formatting tags, so it can be embedded in our own pages.
+func sanitizeHtml(input string) string {
+
+	var out strings.Builder
+
+	tokenizer := html.NewTokenizer(strings.NewReader(input))
+
+	// Depth inside script and style elements, whose contents are dropped
+	// entirely rather than kept as text
+	skipDepth := 0
+
+	for {
+		tokenType := tokenizer.Next()
+
+		switch tokenType {
+		case html.ErrorToken:
+			return out.String()
+		case html.TextToken:
+			if skipDepth == 0 {
+				out.WriteString(html.EscapeString(string(tokenizer.Text())))
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+
+			if token.Data == "script" || token.Data == "style" {
+				if tokenType == html.StartTagToken {
+					skipDepth += 1
+				}
+				continue
+			}
+
+			allowedAttrs, ok := allowedHtmlTags[token.Data]
+			if !ok || skipDepth > 0 {
+				continue
+			}
+
+			attrs := []html.Attribute{}
+			for _, attr := range token.Attr {
+				if !stringInArray(attr.Key, allowedAttrs) {
+					continue
+				}
+
+				if attr.Key == "href" && !isHttpUrl(attr.Val) {
+					continue
+				}
+
+				attrs = append(attrs, attr)
+			}
+			token.Attr = attrs
+
+			out.WriteString(token.String())
+		case html.EndTagToken:
+			token := tokenizer.Token()
+
+			if token.Data == "script" || token.Data == "style" {
+				if skipDepth > 0 {
+					skipDepth -= 1
+				}
+				continue
+			}
+
+			_, ok := allowedHtmlTags[token.Data]
+			if ok && skipDepth == 0 {
+				out.WriteString(token.String())
+			}
+		}
+	}
+}
+
+// Elements whose text is left alone when linking hashtags and mentions,
+// either because it's already a link or because it isn't prose
+var unlinkedHtmlTags = []string{"a", "code", "pre", "script", "style"}
+
+// linkHtmlText rewrites the text of our own rendered HTML, skipping
+// attributes, links and code. Matches of re in each text node are replaced
+// by the HTML replace returns for their submatches, and the rest of the text
+// is escaped again.
+func linkHtmlText(input string, re *regexp.Regexp, replace func(parts []string) string) string {
+
+	var out strings.Builder
+
+	tokenizer := html.NewTokenizer(strings.NewReader(input))
+
+	skipDepth := 0
+
+	for {
+		tokenType := tokenizer.Next()
+
+		if tokenType == html.ErrorToken {
+			return out.String()
+		}
+
+		if tokenType != html.TextToken || skipDepth > 0 {
+			out.Write(tokenizer.Raw())
+
+			tagName, _ := tokenizer.TagName()
+			if !stringInArray(string(tagName), unlinkedHtmlTags) {
+				continue
+			}
+
+			if tokenType == html.StartTagToken {
+				skipDepth += 1
+			} else if tokenType == html.EndTagToken && skipDepth > 0 {
+				skipDepth -= 1
+			}
+
+			continue
+		}
+
+		raw := string(tokenizer.Raw())
+		text := string(tokenizer.Text())
+
+		matches := re.FindAllStringSubmatchIndex(text, -1)
+		if len(matches) == 0 {
+			out.WriteString(raw)
+			continue
+		}
+
+		last := 0
+		for _, loc := range matches {
+			parts := []string{}
+			for i := 0; i < len(loc); i += 2 {
+				part := ""
+				if loc[i] >= 0 {
+					part = text[loc[i]:loc[i+1]]
+				}
+				parts = append(parts, part)
+			}
+
+			out.WriteString(html.EscapeString(text[last:loc[0]]))
+			out.WriteString(replace(parts))
+			last = loc[1]
+		}
+		out.WriteString(html.EscapeString(text[last:]))
+	}
+}
+
+func isHttpUrl(uri string) bool {
+	parsedUrl, err := url.Parse(uri)
+	if err != nil {
+		return false
+	}
+
+	return parsedUrl.Scheme == "https" || parsedUrl.Scheme == "http"
+}
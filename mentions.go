@@ -0,0 +1,185 @@
+package syndicat
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"regexp"
+
+	"github.com/go-ap/activitypub"
+	"github.com/go-ap/client"
+)
+
+// Matches mentions like @user@example.com, as long as they aren't part of a
+// longer word, email address or URL
+var mentionRegex = regexp.MustCompile(`(^|[^\w@/.])@([\w.-]+)@([\w-]+(?:\.[\w-]+)+)`)
+
+type mention struct {
+	Handle string
+	Actor  *activitypub.Actor
+}
+
+// parseMentions returns the unique handles mentioned in text, in the order
+// they first appear.
+func parseMentions(text string) []string {
+
+	handles := []string{}
+
+	for _, match := range mentionRegex.FindAllStringSubmatch(text, -1) {
+		handle := fmt.Sprintf("@%s@%s", match[2], match[3])
+		if !stringInArray(handle, handles) {
+			handles = append(handles, handle)
+		}
+	}
+
+	return handles
+}
+
+// getMentions resolves the handles mentioned in the markdown source of an
+// entry. Handles which don't resolve are left as plain text rather than
+// failing the whole entry.
+func getMentions(httpClient *http.Client, apClient *client.C, markdown string) []*mention {
+
+	mentions := []*mention{}
+
+	for _, handle := range parseMentions(markdown) {
+		actorId, err := resolveHandle(httpClient, handle)
+		if err != nil {
+			fmt.Println(err.Error())
+			continue
+		}
+
+		actor, err := getActor(apClient, actorId)
+		if err != nil {
+			fmt.Println(err.Error())
+			continue
+		}
+
+		mentions = append(mentions, &mention{
+			Handle: handle,
+			Actor:  actor,
+		})
+	}
+
+	return mentions
+}
+
+// addMentions tags an entry with the actors it mentions and addresses it to
+// them, which is what makes servers notify them. Mention tags from a previous
+// version of the entry are replaced.
+func addMentions(entry *activitypub.Object, mentions []*mention) {
+
+	tags := activitypub.ItemCollection{}
+
+	for _, tag := range entry.Tag {
+		if tag != nil && tag.GetType() != activitypub.MentionType {
+			tags = append(tags, tag)
+		}
+	}
+
+	for _, m := range mentions {
+		// go-ap drops tags with the same ID when decoding, so they need
+		// one, even though other servers don't use it
+		tags = append(tags, &activitypub.Mention{
+			ID:   m.Actor.ID,
+			Type: activitypub.MentionType,
+			Href: m.Actor.ID,
+			Name: activitypub.NaturalLanguageValues{
+				activitypub.LangRefValue{
+					Value: []byte(m.Handle),
+				},
+			},
+		})
+
+		if !entry.CC.Contains(m.Actor.ID) {
+			entry.CC = append(entry.CC, m.Actor.ID)
+		}
+	}
+
+	entry.Tag = tags
+}
+
+// getMentionInboxes returns the inboxes of mentioned actors which aren't
+// already in inboxes.
+func getMentionInboxes(mentions []*mention, inboxes []string) []string {
+
+	for _, m := range mentions {
+		inbox := ""
+		if m.Actor.Endpoints != nil && m.Actor.Endpoints.SharedInbox != nil {
+			inbox = string(m.Actor.Endpoints.SharedInbox.GetLink())
+		}
+		if inbox == "" && m.Actor.Inbox != nil {
+			inbox = string(m.Actor.Inbox.GetLink())
+		}
+
+		if inbox != "" && !stringInArray(inbox, inboxes) {
+			inboxes = append(inboxes, inbox)
+		}
+	}
+
+	return inboxes
+}
+
+// linkMentions turns the resolved mentions in rendered HTML into links to the
+// remote profiles, using the markup Mastodon uses for its own mentions.
+// Mentions in links, code and attributes are left alone.
+func linkMentions(contentHtml string, mentions []*mention) string {
+
+	return linkHtmlText(contentHtml, mentionRegex, func(parts []string) string {
+
+		handle := fmt.Sprintf("@%s@%s", parts[2], parts[3])
+
+		for _, m := range mentions {
+			if m.Handle != handle {
+				continue
+			}
+
+			return fmt.Sprintf(`%s<span class="h-card" translate="no"><a href="%s" class="u-url mention">@<span>%s</span></a></span>`,
+				html.EscapeString(parts[1]), html.EscapeString(getActorUrl(m.Actor)), html.EscapeString(parts[2]))
+		}
+
+		return html.EscapeString(parts[0])
+	})
+}
+
+// mentionsDomain checks whether an object mentions the actor for domain.
+func mentionsDomain(obj *activitypub.Object, domain string) bool {
+
+	actorId := activitypub.IRI(fmt.Sprintf("https://%s/ap.jsonld", domain))
+
+	for _, tag := range obj.Tag {
+		if tag == nil || tag.GetType() != activitypub.MentionType {
+			continue
+		}
+
+		link, err := activitypub.ToLink(tag)
+		if err != nil {
+			continue
+		}
+
+		if link.Href == actorId {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getActorUrl returns the profile page of an actor, falling back to its ID.
+func getActorUrl(actor *activitypub.Actor) string {
+
+	if actor.URL == nil {
+		return string(actor.ID)
+	}
+
+	if activitypub.IsIRI(actor.URL) {
+		return string(actor.URL.GetLink())
+	}
+
+	link, err := activitypub.ToLink(actor.URL)
+	if err != nil || link.Href == "" {
+		return string(actor.ID)
+	}
+
+	return string(link.Href)
+}
@@ -0,0 +1,159 @@
+package syndicat
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime/debug"
+	"time"
+)
+
+const nodeInfoSchemaBase = "http://nodeinfo.diaspora.software/ns/schema/"
+
+type NodeInfoDiscovery struct {
+	Links []*NodeInfoLink `json:"links"`
+}
+
+type NodeInfoLink struct {
+	Rel  string `json:"rel"`
+	Href string `json:"href"`
+}
+
+type NodeInfo struct {
+	Version           string            `json:"version"`
+	Software          *NodeInfoSoftware `json:"software"`
+	Protocols         []string          `json:"protocols"`
+	Services          *NodeInfoServices `json:"services"`
+	OpenRegistrations bool              `json:"openRegistrations"`
+	Usage             *NodeInfoUsage    `json:"usage"`
+	Metadata          map[string]string `json:"metadata"`
+}
+
+type NodeInfoSoftware struct {
+	Name       string `json:"name"`
+	Version    string `json:"version"`
+	Repository string `json:"repository,omitempty"`
+	Homepage   string `json:"homepage,omitempty"`
+}
+
+type NodeInfoServices struct {
+	Inbound  []string `json:"inbound"`
+	Outbound []string `json:"outbound"`
+}
+
+type NodeInfoUsage struct {
+	Users      *NodeInfoUsers `json:"users"`
+	LocalPosts int            `json:"localPosts"`
+}
+
+type NodeInfoUsers struct {
+	Total          int `json:"total"`
+	ActiveMonth    int `json:"activeMonth"`
+	ActiveHalfyear int `json:"activeHalfyear"`
+}
+
+var nodeInfoVersions = []string{"2.0", "2.1"}
+
+func getNodeInfoDiscovery(domain string) *NodeInfoDiscovery {
+
+	discovery := &NodeInfoDiscovery{
+		Links: []*NodeInfoLink{},
+	}
+
+	for _, version := range nodeInfoVersions {
+		discovery.Links = append(discovery.Links, &NodeInfoLink{
+			Rel:  nodeInfoSchemaBase + version,
+			Href: fmt.Sprintf("https://%s/nodeinfo/%s", domain, version),
+		})
+	}
+
+	return discovery
+}
+
+// getNodeInfo builds the NodeInfo document for a hosted domain. Each domain
+// has a single user, so the usage numbers only cover that user.
+func getNodeInfo(sourceDir, domain, version string) (*NodeInfo, error) {
+
+	if !stringInArray(version, nodeInfoVersions) {
+		return nil, fmt.Errorf("Unsupported NodeInfo version %s", version)
+	}
+
+	entries, err := getAllEntries(filepath.Join(sourceDir, domain))
+	if err != nil {
+		return nil, err
+	}
+
+	lastPublished := time.Time{}
+	for _, entry := range entries {
+		if entry.Published.After(lastPublished) {
+			lastPublished = entry.Published
+		}
+	}
+
+	users := &NodeInfoUsers{
+		Total: 1,
+	}
+
+	if time.Since(lastPublished) < 30*24*time.Hour {
+		users.ActiveMonth = 1
+	}
+
+	if time.Since(lastPublished) < 180*24*time.Hour {
+		users.ActiveHalfyear = 1
+	}
+
+	software := &NodeInfoSoftware{
+		Name:    "syndicat",
+		Version: getVersion(),
+	}
+
+	// repository and homepage were added in 2.1
+	if version != "2.0" {
+		software.Repository = "https://github.com/anderspitman/syndicat-go"
+		software.Homepage = "https://github.com/anderspitman/syndicat-go"
+	}
+
+	nodeInfo := &NodeInfo{
+		Version:   version,
+		Software:  software,
+		Protocols: []string{"activitypub"},
+		Services: &NodeInfoServices{
+			Inbound:  []string{},
+			Outbound: []string{"atom1.0"},
+		},
+		// Users are added by creating their domain directory, there's no
+		// way to sign up
+		OpenRegistrations: false,
+		Usage: &NodeInfoUsage{
+			Users:      users,
+			LocalPosts: len(entries),
+		},
+		Metadata: map[string]string{},
+	}
+
+	return nodeInfo, nil
+}
+
+// getVersion returns the version of this module that was built into the
+// running binary, which works both for cmd/syndicat and for other programs
+// that import us.
+func getVersion() string {
+
+	buildInfo, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+
+	modulePath := "github.com/anderspitman/syndicat-go"
+
+	if buildInfo.Main.Path == modulePath {
+		return buildInfo.Main.Version
+	}
+
+	for _, dep := range buildInfo.Deps {
+		if dep.Path == modulePath {
+			return dep.Version
+		}
+	}
+
+	return "unknown"
+}
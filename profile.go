@@ -0,0 +1,153 @@
+package syndicat
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/go-ap/activitypub"
+	"github.com/go-ap/jsonld"
+	"github.com/yuin/goldmark"
+)
+
+// Profile holds the user details for a hosted domain. It's read from
+// profile.json in the user source dir. Avatar and Header can either be full
+// URLs or paths relative to the domain root.
+type Profile struct {
+	Username                  string          `json:"username"`
+	DisplayName               string          `json:"display_name"`
+	Bio                       string          `json:"bio"`
+	Avatar                    string          `json:"avatar"`
+	Header                    string          `json:"header"`
+	Fields                    []*ProfileField `json:"fields"`
+	ManuallyApprovesFollowers bool            `json:"manually_approves_followers"`
+}
+
+type ProfileField struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// loadProfile reads the profile for a user. Users without a profile.json get
+// the defaults, which match what we published before profiles existed.
+func loadProfile(userSourceDir string) (*Profile, error) {
+
+	profile := &Profile{
+		Username: "me",
+		Avatar:   "portrait.jpg",
+	}
+
+	profileBytes, err := os.ReadFile(filepath.Join(userSourceDir, "profile.json"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if err == nil {
+		err = json.Unmarshal(profileBytes, profile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if profile.DisplayName == "" {
+		profile.DisplayName = profile.Username
+	}
+
+	return profile, nil
+}
+
+func (p *Profile) AvatarUri(domain string) string {
+	return getProfileUri(domain, p.Avatar)
+}
+
+func (p *Profile) HeaderUri(domain string) string {
+	return getProfileUri(domain, p.Header)
+}
+
+// BioHtml renders the bio, which is written in markdown.
+func (p *Profile) BioHtml() (string, error) {
+	var bioHtmlBuf bytes.Buffer
+	err := goldmark.Convert([]byte(p.Bio), &bioHtmlBuf)
+	if err != nil {
+		return "", err
+	}
+
+	return bioHtmlBuf.String(), nil
+}
+
+func getProfileUri(domain, uri string) string {
+	if uri == "" || isHttpUrl(uri) {
+		return uri
+	}
+
+	return fmt.Sprintf("https://%s/%s", domain, path.Clean(uri))
+}
+
+func getImage(uri string) activitypub.Image {
+	return activitypub.Image{
+		Type:      activitypub.ImageType,
+		MediaType: activitypub.MimeType(mime.TypeByExtension(path.Ext(uri))),
+		URL:       activitypub.IRI(uri),
+	}
+}
+
+// marshalActor serializes an actor along with the profile properties which
+// go-ap doesn't know about, namely the metadata fields and
+// manuallyApprovesFollowers.
+func marshalActor(actor *activitypub.Actor, profile *Profile) ([]byte, error) {
+
+	actorBytes, err := jsonld.WithContext(
+		jsonld.IRI(activitypub.ActivityBaseURI),
+	).Marshal(actor)
+	if err != nil {
+		return nil, err
+	}
+
+	var actorMap map[string]interface{}
+	err = json.Unmarshal(actorBytes, &actorMap)
+	if err != nil {
+		return nil, err
+	}
+
+	actorMap["@context"] = []interface{}{
+		activitypub.ActivityBaseURI,
+		"https://w3id.org/security/v1",
+		map[string]string{
+			"manuallyApprovesFollowers": "as:manuallyApprovesFollowers",
+			"schema":                    "http://schema.org#",
+			"PropertyValue":             "schema:PropertyValue",
+			"value":                     "schema:value",
+		},
+	}
+
+	actorMap["manuallyApprovesFollowers"] = profile.ManuallyApprovesFollowers
+
+	if len(profile.Fields) > 0 {
+		attachment := []map[string]string{}
+
+		for _, field := range profile.Fields {
+
+			value := html.EscapeString(field.Value)
+
+			// rel=me lets Mastodon verify links back to us
+			if isHttpUrl(field.Value) {
+				value = fmt.Sprintf(`<a href="%s" rel="me nofollow noopener" target="_blank">%s</a>`, value, value)
+			}
+
+			attachment = append(attachment, map[string]string{
+				"type":  "PropertyValue",
+				"name":  field.Name,
+				"value": value,
+			})
+		}
+
+		actorMap["attachment"] = attachment
+	}
+
+	return json.Marshal(actorMap)
+}
@@ -0,0 +1,114 @@
+package syndicat
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/go-ap/activitypub"
+	"github.com/go-ap/client"
+)
+
+// addReaction stores a Like or Announce of one of the entries on domain. It
+// returns false if the activity targets something which isn't ours.
+func addReaction(db *SqliteDatabase, apClient *client.C, sourceDir, domain string, act *activitypub.Activity) (bool, error) {
+
+	if act.Object == nil {
+		return false, nil
+	}
+
+	// Otherwise anyone could replace someone else's reaction by reusing its ID
+	if !isSameHost(act.ID, act.Actor.GetID()) {
+		return false, nil
+	}
+
+	entryId, ok := getLocalEntryId(domain, act.Object.GetLink())
+	if !ok {
+		return false, nil
+	}
+
+	entryDir := filepath.Join(sourceDir, domain, strconv.Itoa(entryId))
+	if !isDir(entryDir) {
+		return false, nil
+	}
+
+	actor, err := getActor(apClient, act.Actor.GetID())
+	if err != nil {
+		return false, err
+	}
+
+	published := act.Published
+	if published.IsZero() {
+		published = time.Now()
+	}
+
+	reaction := &Reaction{
+		Domain:    domain,
+		EntryId:   entryId,
+		Type:      string(act.Type),
+		Id:        string(act.ID),
+		Actor:     string(actor.ID),
+		ActorName: getActorName(actor),
+		ActorIcon: getActorIcon(actor),
+		Published: published,
+	}
+
+	err = db.SetReaction(reaction)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// getReactionsCollection builds the likes or shares collection published on
+// an entry, which lists the IDs of the Like or Announce activities.
+func getReactionsCollection(db *SqliteDatabase, domain string, entryId int, reactionType activitypub.ActivityVocabularyType, filename string) (*activitypub.OrderedCollection, error) {
+
+	reactions, err := db.GetReactions(domain, entryId, string(reactionType))
+	if err != nil {
+		return nil, err
+	}
+
+	collectionId := activitypub.IRI(fmt.Sprintf("https://%s/%d/%s", domain, entryId, filename))
+	collection := activitypub.OrderedCollectionNew(collectionId)
+
+	for _, reaction := range reactions {
+		collection.OrderedItems = append(collection.OrderedItems, activitypub.IRI(reaction.Id))
+	}
+
+	collection.TotalItems = uint(len(collection.OrderedItems))
+
+	return collection, nil
+}
+
+func getActorName(actor *activitypub.Actor) string {
+	name := string(actor.Name.First().Value)
+	if name == "" {
+		name = string(actor.PreferredUsername.First().Value)
+	}
+
+	if name == "" {
+		name = string(actor.ID)
+	}
+
+	return name
+}
+
+func getActorIcon(actor *activitypub.Actor) string {
+	if actor.Icon == nil {
+		return ""
+	}
+
+	if activitypub.IsIRI(actor.Icon) {
+		return string(actor.Icon.GetLink())
+	}
+
+	icon, err := activitypub.ToObject(actor.Icon)
+	if err != nil || icon.URL == nil {
+		return ""
+	}
+
+	return string(icon.URL.GetLink())
+}
@@ -2,31 +2,22 @@ package syndicat
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	iofs "io/fs"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/cbroglie/mustache"
 	"github.com/go-ap/activitypub"
-	"github.com/go-ap/jsonld"
 	"github.com/gorilla/feeds"
 )
 
-type WebFingerAccount struct {
-	Subject string           `json:"subject"`
-	Links   []*WebFingerLink `json:"links"`
-}
-
-type WebFingerLink struct {
-	Rel  string `json:"rel"`
-	Type string `json:"type"`
-	Href string `json:"href"`
-}
-
 type PartialProvider struct {
 	fs iofs.ReadFileFS
 }
@@ -47,7 +38,14 @@ func (p *PartialProvider) Get(tmplPath string) (string, error) {
 	return string(tmplBytes), nil
 }
 
-func render(rootUri, sourceDir, serveDir string, partialProvider *PartialProvider) error {
+// Renders are kicked off by inbox activity as well as by the editor, and
+// would otherwise trample each other's output
+var renderMut sync.Mutex
+
+func render(db *SqliteDatabase, rootUri, sourceDir, serveDir string, partialProvider *PartialProvider) error {
+
+	renderMut.Lock()
+	defer renderMut.Unlock()
 
 	err := ensureDir(sourceDir)
 	if err != nil {
@@ -64,6 +62,9 @@ func render(rootUri, sourceDir, serveDir string, partialProvider *PartialProvide
 		return err
 	}
 
+	// All of the domains share one inbox, which is served from the main one
+	sharedInboxUri := fmt.Sprintf("https://%s/shared-inbox", rootUri)
+
 	for _, userDirEntry := range dirItems {
 		if !userDirEntry.IsDir() {
 			continue
@@ -72,7 +73,7 @@ func render(rootUri, sourceDir, serveDir string, partialProvider *PartialProvide
 		userRootUri := domainName
 		userSourceDir := filepath.Join(sourceDir, domainName)
 		userServeDir := filepath.Join(serveDir, domainName)
-		err = renderUser(userRootUri, userSourceDir, userServeDir, partialProvider)
+		err = renderUser(db, userRootUri, userSourceDir, userServeDir, sharedInboxUri, partialProvider)
 		if err != nil {
 			return err
 		}
@@ -81,7 +82,38 @@ func render(rootUri, sourceDir, serveDir string, partialProvider *PartialProvide
 	return nil
 }
 
-func renderUser(rootUri, sourceDir, serveDir string, partialProvider *PartialProvider) error {
+// isHostedDomain checks whether domain is one of the domains we serve users
+// for, which each have a directory (and key) in sourceDir.
+func isHostedDomain(sourceDir, domain string) bool {
+
+	if domain == "" || strings.HasPrefix(domain, ".") || strings.ContainsAny(domain, "/\\") {
+		return false
+	}
+
+	_, err := os.Stat(filepath.Join(sourceDir, domain, "private_key.pem"))
+	return err == nil
+}
+
+// getHostedDomains lists the domains we serve users for.
+func getHostedDomains(sourceDir string) ([]string, error) {
+
+	dirItems, err := os.ReadDir(sourceDir)
+	if err != nil {
+		return nil, err
+	}
+
+	domains := []string{}
+
+	for _, item := range dirItems {
+		if item.IsDir() && isHostedDomain(sourceDir, item.Name()) {
+			domains = append(domains, item.Name())
+		}
+	}
+
+	return domains, nil
+}
+
+func renderUser(db *SqliteDatabase, rootUri, sourceDir, serveDir, sharedInboxUri string, partialProvider *PartialProvider) error {
 
 	err := os.MkdirAll(sourceDir, 0755)
 	if err != nil {
@@ -104,6 +136,16 @@ func renderUser(rootUri, sourceDir, serveDir string, partialProvider *PartialPro
 		return err
 	}
 
+	profile, err := loadProfile(sourceDir)
+	if err != nil {
+		return err
+	}
+
+	bioHtml, err := profile.BioHtml()
+	if err != nil {
+		return err
+	}
+
 	entriesDir := sourceDir
 
 	dirItems, err := os.ReadDir(entriesDir)
@@ -112,6 +154,7 @@ func renderUser(rootUri, sourceDir, serveDir string, partialProvider *PartialPro
 	}
 
 	feedItems := []*feeds.Item{}
+	feedItemsById := map[int]*feeds.Item{}
 	var outboxItems activitypub.ItemCollection
 
 	for _, item := range dirItems {
@@ -127,6 +170,10 @@ func renderUser(rootUri, sourceDir, serveDir string, partialProvider *PartialPro
 		entryTextPath := filepath.Join(entryDir, "activity.jsonld")
 
 		activityBytes, err := os.ReadFile(entryTextPath)
+		if os.IsNotExist(err) {
+			// Deleted entries only have a Tombstone left
+			continue
+		}
 		if err != nil {
 			return err
 		}
@@ -147,6 +194,11 @@ func renderUser(rootUri, sourceDir, serveDir string, partialProvider *PartialPro
 			return err
 		}
 
+		err = loadHashtags(activityBytes, entry)
+		if err != nil {
+			return err
+		}
+
 		entryRenderDir := fmt.Sprintf("%s/%d", serveDir, entryId)
 		entryHtmlPath := filepath.Join(entryRenderDir, "index.html")
 
@@ -157,22 +209,50 @@ func renderUser(rootUri, sourceDir, serveDir string, partialProvider *PartialPro
 
 		contentHtml := string(entry.Content.First().Value)
 
-		renderEntry, err := convertApObject(entry)
+		replies, err := getRepliesCollection(db, rootUri, entryId)
 		if err != nil {
 			return err
 		}
 
-		tmplData := struct {
-			Entry       *ActivityPubObject
-			ContentHtml string
-			LoggedIn    bool
-		}{
-			Entry:       renderEntry,
-			ContentHtml: contentHtml,
-			LoggedIn:    true,
+		err = writeOrderedCollection(filepath.Join(entryRenderDir, "replies.jsonld"), replies)
+		if err != nil {
+			return err
+		}
+
+		entry.Replies = replies
+
+		likes, err := getReactionsCollection(db, rootUri, entryId, activitypub.LikeType, "likes.jsonld")
+		if err != nil {
+			return err
+		}
+
+		err = writeOrderedCollection(filepath.Join(entryRenderDir, "likes.jsonld"), likes)
+		if err != nil {
+			return err
+		}
+
+		entry.Likes = likes
+
+		shares, err := getReactionsCollection(db, rootUri, entryId, activitypub.AnnounceType, "shares.jsonld")
+		if err != nil {
+			return err
+		}
+
+		err = writeOrderedCollection(filepath.Join(entryRenderDir, "shares.jsonld"), shares)
+		if err != nil {
+			return err
+		}
+
+		entry.Shares = shares
+
+		err = writeObject(filepath.Join(entryRenderDir, "entry.jsonld"), entry)
+		if err != nil {
+			return err
 		}
 
-		entryHtml, err := renderTemplate("templates/entry.html", tmplData, partialProvider)
+		// Published pages never have the edit controls, which are only
+		// shown when the page is served to someone logged in
+		entryHtml, err := renderEntryPage(db, rootUri, entryId, entry, false, partialProvider)
 		if err != nil {
 			return err
 		}
@@ -208,6 +288,13 @@ func renderUser(rootUri, sourceDir, serveDir string, partialProvider *PartialPro
 			return err
 		}
 
+		// The editor used to be published alongside each entry, but it's
+		// served to logged in users now
+		err = os.RemoveAll(filepath.Join(entryRenderDir, "edit"))
+		if err != nil {
+			return err
+		}
+
 		author := activitypub.IRI(rootUri)
 		if activitypub.IsIRI(entry.AttributedTo) && entry.AttributedTo != activitypub.IRI("") {
 			author = entry.AttributedTo.(activitypub.IRI)
@@ -226,12 +313,25 @@ func renderUser(rootUri, sourceDir, serveDir string, partialProvider *PartialPro
 			Updated: entry.Updated,
 		}
 
-		feedItems = append(feedItems, feedItem)
-		outboxItems = append(outboxItems, activity)
+		visibility := getVisibility(rootUri, entry)
+
+		// Unlisted entries are still public, they just aren't listed
+		// anywhere but the outbox
+		if visibility == VisibilityPublic {
+			feedItems = append(feedItems, feedItem)
+			feedItemsById[entryId] = feedItem
+		}
+
+		if isPublicVisibility(visibility) {
+			outboxItems = append(outboxItems, activity)
+		}
 	}
 
 	feed := &feeds.Feed{
-		Title: "IndieHost.org feed",
+		Title: fmt.Sprintf("%s's feed", profile.DisplayName),
+		Author: &feeds.Author{
+			Name: profile.DisplayName,
+		},
 		Link: &feeds.Link{
 			Href: fmt.Sprintf("https://%s/feed.xml", rootUri),
 			Rel:  "self",
@@ -271,19 +371,15 @@ func renderUser(rootUri, sourceDir, serveDir string, partialProvider *PartialPro
 		return err
 	}
 
-	apOutboxUri := fmt.Sprintf("https://%s/outbox.jsonld", rootUri)
-	apOutbox := activitypub.OrderedCollectionNew(activitypub.IRI(apOutboxUri))
-	apOutbox.OrderedItems = outboxItems
-	apOutbox.TotalItems = uint(len(outboxItems))
+	// Entry directories are listed in lexical order, but collection pages
+	// go newest first
+	sort.SliceStable(outboxItems, func(i, j int) bool {
+		iPublished := outboxItems[i].(*activitypub.Activity).Published
+		jPublished := outboxItems[j].(*activitypub.Activity).Published
+		return iPublished.After(jPublished)
+	})
 
-	outboxJson, err := jsonld.WithContext(
-		jsonld.IRI(activitypub.ActivityBaseURI),
-	).Marshal(apOutbox)
-	if err != nil {
-		return err
-	}
-
-	err = os.WriteFile(filepath.Join(serveDir, "outbox.jsonld"), outboxJson, 0644)
+	err = writePagedCollection(serveDir, rootUri, "outbox", outboxItems)
 	if err != nil {
 		return err
 	}
@@ -293,56 +389,33 @@ func renderUser(rootUri, sourceDir, serveDir string, partialProvider *PartialPro
 		return err
 	}
 
-	wf := &WebFingerAccount{
-		Subject: fmt.Sprintf("me17@%s", rootUri),
-		Links: []*WebFingerLink{
-			&WebFingerLink{
-				Rel:  "self",
-				Type: "application/activity+json",
-				Href: fmt.Sprintf("https://%s/ap.jsonld", rootUri),
-			},
-		},
-	}
-
-	wfJsonBytes, err := json.MarshalIndent(wf, "", "  ")
-	if err != nil {
-		return err
-	}
-
-	wfPath := filepath.Join(serveDir, ".well-known", "webfinger")
-
-	err = os.MkdirAll(filepath.Dir(wfPath), 0755)
-	if err != nil {
-		return err
-	}
-
-	err = os.WriteFile(wfPath, wfJsonBytes, 0644)
-	if err != nil {
-		return err
-	}
-
 	actorId := activitypub.IRI(fmt.Sprintf("https://%s/ap.jsonld", rootUri))
 	pubKeyId := actorId + "#main-key"
 	apActor := &activitypub.Actor{
-		ID:  actorId,
-		URL: activitypub.IRI(fmt.Sprintf("https://%s", rootUri)),
-		Icon: activitypub.Image{
-			Type:      activitypub.ImageType,
-			MediaType: "image/jpeg",
-			URL:       activitypub.IRI(fmt.Sprintf("https://%s/portrait.jpg", rootUri)),
-		},
+		ID:        actorId,
+		URL:       activitypub.IRI(fmt.Sprintf("https://%s", rootUri)),
+		Icon:      getImage(profile.AvatarUri(rootUri)),
 		Type:      "Person",
 		Inbox:     activitypub.IRI(fmt.Sprintf("https://%s/inbox", rootUri)),
 		Outbox:    activitypub.IRI(fmt.Sprintf("https://%s/outbox.jsonld", rootUri)),
 		Followers: activitypub.IRI(fmt.Sprintf("https://%s/followers.jsonld", rootUri)),
+		Following: activitypub.IRI(fmt.Sprintf("https://%s/following.jsonld", rootUri)),
+		Endpoints: &activitypub.Endpoints{
+			SharedInbox: activitypub.IRI(sharedInboxUri),
+		},
 		PreferredUsername: activitypub.NaturalLanguageValues{
 			activitypub.LangRefValue{
-				Value: []byte("me"),
+				Value: []byte(profile.Username),
 			},
 		},
 		Name: activitypub.NaturalLanguageValues{
 			activitypub.LangRefValue{
-				Value: []byte("me"),
+				Value: []byte(profile.DisplayName),
+			},
+		},
+		Summary: activitypub.NaturalLanguageValues{
+			activitypub.LangRefValue{
+				Value: []byte(bioHtml),
 			},
 		},
 		PublicKey: activitypub.PublicKey{
@@ -352,10 +425,12 @@ func renderUser(rootUri, sourceDir, serveDir string, partialProvider *PartialPro
 		},
 	}
 
+	if profile.Header != "" {
+		apActor.Image = getImage(profile.HeaderUri(rootUri))
+	}
+
 	// See here: https://github.com/go-ap/activitypub/issues/11
-	apProfileBytes, err := jsonld.WithContext(
-		jsonld.IRI(activitypub.ActivityBaseURI),
-	).Marshal(apActor)
+	apProfileBytes, err := marshalActor(apActor, profile)
 	if err != nil {
 		return err
 	}
@@ -367,31 +442,32 @@ func renderUser(rootUri, sourceDir, serveDir string, partialProvider *PartialPro
 		return err
 	}
 
-	followersPath := filepath.Join(serveDir, "followers.jsonld")
-
-	followersId := activitypub.IRI(fmt.Sprintf("https://%s/followers.jsonld", rootUri))
-	followersBytes, err := os.ReadFile(followersPath)
+	err = writeFollowersCollection(db, serveDir, rootUri)
 	if err != nil {
-		followers := activitypub.OrderedCollectionNew(followersId)
-		followersBytes, err = jsonld.WithContext(
-			jsonld.IRI(activitypub.ActivityBaseURI),
-		).Marshal(followers)
-		if err != nil {
-			return err
-		}
+		return err
+	}
 
-		err = os.WriteFile(followersPath, followersBytes, 0644)
-		if err != nil {
-			return err
-		}
+	err = writeFollowingCollection(db, serveDir, rootUri)
+	if err != nil {
+		return err
 	}
 
 	templateData := struct {
-		Title    string
-		LoggedIn bool
+		Title     string
+		Profile   *Profile
+		AvatarUri string
+		BioHtml   string
+		HomeUri   string
+		HasFields bool
+		LoggedIn  bool
 	}{
-		Title:    rootUri,
-		LoggedIn: true,
+		Title:     rootUri,
+		Profile:   profile,
+		AvatarUri: profile.AvatarUri(rootUri),
+		BioHtml:   bioHtml,
+		HomeUri:   fmt.Sprintf("https://%s/", rootUri),
+		HasFields: len(profile.Fields) > 0,
+		LoggedIn:  false,
 	}
 
 	indexHtml, err := renderTemplate("templates/index.html", templateData, partialProvider)
@@ -405,11 +481,15 @@ func renderUser(rootUri, sourceDir, serveDir string, partialProvider *PartialPro
 	}
 
 	editorTmplData := struct {
-		Title    string
-		LoggedIn bool
+		Title        string
+		Action       string
+		Visibilities []*visibilityOption
+		LoggedIn     bool
 	}{
-		Title:    "Entree Entry",
-		LoggedIn: true,
+		Title:        "Entree Entry",
+		Action:       "/entry-submit",
+		Visibilities: getVisibilityOptions(VisibilityPublic),
+		LoggedIn:     true,
 	}
 
 	editorTmplHtml, err := renderTemplate("templates/entry-editor.html", editorTmplData, partialProvider)
@@ -429,8 +509,15 @@ func renderUser(rootUri, sourceDir, serveDir string, partialProvider *PartialPro
 		return err
 	}
 
+	forumEntries := []*activitypub.Object{}
+	for _, entry := range allEntries {
+		if getVisibility(rootUri, entry) == VisibilityPublic {
+			forumEntries = append(forumEntries, entry)
+		}
+	}
+
 	forumDir := filepath.Join(sourceDir, "forum")
-	err = renderForum(forumDir, allEntries, partialProvider)
+	err = renderForum(forumDir, forumEntries, partialProvider)
 	if err != nil {
 		return err
 	}
@@ -440,9 +527,103 @@ func renderUser(rootUri, sourceDir, serveDir string, partialProvider *PartialPro
 		return err
 	}
 
+	err = renderTags(db, rootUri, serveDir, profile, feedItemsById, partialProvider)
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
+// renderEntryPage renders the HTML page of an entry on domain. The edit and
+// delete controls are only included if loggedIn is set, so those pages
+// mustn't be published.
+func renderEntryPage(db *SqliteDatabase, domain string, entryId int, entry *activitypub.Object, loggedIn bool, partialProvider *PartialProvider) (string, error) {
+
+	renderEntry, err := convertApObject(entry)
+	if err != nil {
+		return "", err
+	}
+
+	// The published collection only lists direct replies, but the page
+	// shows the whole thread
+	renderEntry.Replies, err = getReplyTree(db, domain, entryId)
+	if err != nil {
+		return "", err
+	}
+
+	likeReactions, err := db.GetReactions(domain, entryId, string(activitypub.LikeType))
+	if err != nil {
+		return "", err
+	}
+
+	shareReactions, err := db.GetReactions(domain, entryId, string(activitypub.AnnounceType))
+	if err != nil {
+		return "", err
+	}
+
+	tmplData := struct {
+		Entry        *ActivityPubObject
+		ContentHtml  string
+		HasReplies   bool
+		HasReactions bool
+		Likes        []*Reaction
+		Shares       []*Reaction
+		LikeCount    int
+		ShareCount   int
+		EntryId      int
+		LoggedIn     bool
+	}{
+		EntryId:      entryId,
+		Entry:        renderEntry,
+		ContentHtml:  string(entry.Content.First().Value),
+		HasReplies:   len(renderEntry.Replies) > 0,
+		HasReactions: len(likeReactions) > 0 || len(shareReactions) > 0,
+		Likes:        likeReactions,
+		Shares:       shareReactions,
+		LikeCount:    len(likeReactions),
+		ShareCount:   len(shareReactions),
+		LoggedIn:     loggedIn,
+	}
+
+	return renderTemplate("templates/entry.html", tmplData, partialProvider)
+}
+
+// renderEntryEditor renders the form for editing an entry on domain.
+func renderEntryEditor(domain string, entryId int, entry *activitypub.Object, partialProvider *PartialProvider) (string, error) {
+
+	parentUri := ""
+	if entry.InReplyTo != nil {
+		parentUri = string(entry.InReplyTo.GetLink())
+	}
+
+	editTmplData := struct {
+		Title        string
+		Action       string
+		Editing      bool
+		EntryId      int
+		TitleText    string
+		EntryText    string
+		ParentUri    string
+		TagsText     string
+		Visibilities []*visibilityOption
+		LoggedIn     bool
+	}{
+		Title:        "Edit Entry",
+		Action:       "/entry-update",
+		Editing:      true,
+		EntryId:      entryId,
+		TitleText:    string(entry.Name.First().Value),
+		EntryText:    string(entry.Source.Content.First().Value),
+		ParentUri:    parentUri,
+		TagsText:     strings.Join(getEntryTags(entry), ", "),
+		Visibilities: getVisibilityOptions(getVisibility(domain, entry)),
+		LoggedIn:     true,
+	}
+
+	return renderTemplate("templates/entry-editor.html", editTmplData, partialProvider)
+}
+
 func renderBlog(feedItems []*feeds.Item, serveDir string, partialProvider *PartialProvider) error {
 
 	blogTmplData := struct {
@@ -450,7 +631,7 @@ func renderBlog(feedItems []*feeds.Item, serveDir string, partialProvider *Parti
 		LoggedIn bool
 	}{
 		Entries:  feedItems,
-		LoggedIn: true,
+		LoggedIn: false,
 	}
 
 	blogHtml, err := renderTemplate("templates/blog.html", blogTmplData, partialProvider)
@@ -468,6 +649,118 @@ func renderBlog(feedItems []*feeds.Item, serveDir string, partialProvider *Parti
 	return nil
 }
 
+// renderTags writes a page and an Atom feed for each tag used on a domain.
+// Pages are replaced in place, and only then are the pages of tags which are
+// no longer used removed, so current tags never go missing.
+func renderTags(db *SqliteDatabase, rootUri, serveDir string, profile *Profile, feedItemsById map[int]*feeds.Item, partialProvider *PartialProvider) error {
+
+	tagsDir := filepath.Join(serveDir, "tags")
+
+	tags, err := db.GetTags(rootUri)
+	if err != nil {
+		return err
+	}
+
+	renderedTags := []string{}
+
+	for _, tag := range tags {
+
+		entryIds, err := db.GetTaggedEntryIds(rootUri, tag)
+		if err != nil {
+			return err
+		}
+
+		tagItems := []*feeds.Item{}
+
+		for _, entryId := range entryIds {
+			feedItem, exists := feedItemsById[entryId]
+			if exists {
+				tagItems = append(tagItems, feedItem)
+			}
+		}
+
+		if len(tagItems) == 0 {
+			continue
+		}
+
+		tagDir := filepath.Join(tagsDir, tag)
+		feedUri := getTagUri(rootUri, tag) + "feed.xml"
+
+		feed := &feeds.Feed{
+			Title: fmt.Sprintf("%s's feed for #%s", profile.DisplayName, tag),
+			Author: &feeds.Author{
+				Name: profile.DisplayName,
+			},
+			Link: &feeds.Link{
+				Href: feedUri,
+				Rel:  "self",
+			},
+			Items:   tagItems,
+			Updated: time.Now(),
+		}
+
+		atom, err := feed.ToAtom()
+		if err != nil {
+			return err
+		}
+
+		err = ensureDir(tagDir)
+		if err != nil {
+			return err
+		}
+
+		err = writeFileAtomic(filepath.Join(tagDir, "feed.xml"), []byte(atom))
+		if err != nil {
+			return err
+		}
+
+		tmplData := struct {
+			Tag      string
+			FeedUri  string
+			Entries  []*feeds.Item
+			LoggedIn bool
+		}{
+			Tag:      tag,
+			FeedUri:  feedUri,
+			Entries:  tagItems,
+			LoggedIn: false,
+		}
+
+		tagHtml, err := renderTemplate("templates/tag.html", tmplData, partialProvider)
+		if err != nil {
+			return err
+		}
+
+		err = writeFileAtomic(filepath.Join(tagDir, "index.html"), []byte(tagHtml))
+		if err != nil {
+			return err
+		}
+
+		renderedTags = append(renderedTags, tag)
+	}
+
+	tagDirItems, err := os.ReadDir(tagsDir)
+	if errors.Is(err, iofs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, item := range tagDirItems {
+		if stringInArray(item.Name(), renderedTags) {
+			continue
+		}
+
+		err = os.RemoveAll(filepath.Join(tagsDir, item.Name()))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func renderForum(dstDir string, allEntries []*activitypub.Object, partialProvider *PartialProvider) error {
 
 	ensureDir(dstDir)
@@ -0,0 +1,251 @@
+package syndicat
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-ap/activitypub"
+	"github.com/go-ap/jsonld"
+)
+
+// getLocalEntryId returns the ID of the entry on domain which iri refers to.
+// Both the HTML URI and the URIs of the JSON documents in the entry directory
+// are accepted, since remote servers might use either.
+func getLocalEntryId(domain string, iri activitypub.IRI) (int, bool) {
+
+	parsedUri, err := url.Parse(string(iri))
+	if err != nil {
+		return 0, false
+	}
+
+	if parsedUri.Host != domain {
+		return 0, false
+	}
+
+	entryIdStr := strings.Split(strings.Trim(parsedUri.Path, "/"), "/")[0]
+
+	entryId, err := strconv.Atoi(entryIdStr)
+	if err != nil {
+		return 0, false
+	}
+
+	return entryId, true
+}
+
+// addReply stores a remote object if it's part of the thread below one of the
+// entries on domain, either as a direct reply or as a reply to a reply we
+// already have. It returns false if the object isn't a reply to anything of
+// ours.
+func addReply(db *SqliteDatabase, sourceDir, domain string, obj *activitypub.Object) (bool, error) {
+
+	if obj.InReplyTo == nil || !isHttpUrl(string(obj.ID)) {
+		return false, nil
+	}
+
+	inReplyTo := obj.InReplyTo.GetLink()
+
+	entryId, ok := getLocalEntryId(domain, inReplyTo)
+	if !ok {
+		parent, err := db.GetReply(string(inReplyTo))
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+
+		if parent.Domain != domain {
+			return false, nil
+		}
+
+		entryId = parent.EntryId
+	}
+
+	entryDir := filepath.Join(sourceDir, domain, strconv.Itoa(entryId))
+	if !isDir(entryDir) {
+		return false, nil
+	}
+
+	// Edits come in as Updates, so a Create never replaces a reply we
+	// already have, least of all someone else's
+	_, err := db.GetReply(string(obj.ID))
+	if err == nil {
+		return false, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return false, err
+	}
+
+	err = storeReply(db, domain, entryId, obj)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// updateReply replaces the stored copy of a reply. It returns false if we
+// don't have the reply, or it belongs to someone else.
+func updateReply(db *SqliteDatabase, obj *activitypub.Object) (bool, error) {
+
+	existing, err := db.GetReply(string(obj.ID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if obj.AttributedTo == nil || existing.Actor != string(obj.AttributedTo.GetLink()) {
+		return false, nil
+	}
+
+	// Keep the reply where it is in the thread even if inReplyTo changed
+	obj.InReplyTo = activitypub.IRI(existing.InReplyTo)
+
+	if obj.Published.IsZero() {
+		obj.Published = existing.Published
+	}
+
+	err = storeReply(db, existing.Domain, existing.EntryId, obj)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// deleteReply removes a stored reply on behalf of actorId. It returns false
+// if we don't have the reply, or it belongs to someone else.
+func deleteReply(db *SqliteDatabase, actorId, replyId activitypub.IRI) (bool, error) {
+
+	existing, err := db.GetReply(string(replyId))
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if existing.Actor != string(actorId) {
+		return false, nil
+	}
+
+	err = db.DeleteReply(existing.Id)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func storeReply(db *SqliteDatabase, domain string, entryId int, obj *activitypub.Object) error {
+
+	content := sanitizeHtml(string(obj.Content.First().Value))
+	obj.Content = activitypub.NaturalLanguageValues{
+		activitypub.LangRefValue{
+			Value: []byte(content),
+		},
+	}
+
+	objBytes, err := jsonld.Marshal(obj)
+	if err != nil {
+		return err
+	}
+
+	published := obj.Published
+	if published.IsZero() {
+		published = time.Now()
+	}
+
+	reply := &Reply{
+		Domain:    domain,
+		EntryId:   entryId,
+		Id:        string(obj.ID),
+		InReplyTo: string(obj.InReplyTo.GetLink()),
+		Actor:     string(obj.AttributedTo.GetLink()),
+		Object:    string(objBytes),
+		Published: published,
+	}
+
+	return db.SetReply(reply)
+}
+
+// getReplyTree loads the stored replies for an entry and nests each one
+// under the reply it responds to. Replies to the entry itself, and replies
+// whose parent we don't have, end up at the top level.
+func getReplyTree(db *SqliteDatabase, domain string, entryId int) ([]*ActivityPubObject, error) {
+
+	replies, err := db.GetReplies(domain, entryId)
+	if err != nil {
+		return nil, err
+	}
+
+	converted := []*ActivityPubObject{}
+	byId := make(map[string]*ActivityPubObject)
+
+	for _, reply := range replies {
+		var obj *activitypub.Object
+		err = jsonld.Unmarshal([]byte(reply.Object), &obj)
+		if err != nil {
+			return nil, err
+		}
+
+		renderReply, err := convertApObject(obj)
+		if err != nil {
+			return nil, err
+		}
+
+		// Replies stored before convertApObject checked URLs may still have
+		// a bad ID, which mustn't end up in a link either
+		if renderReply.HtmlUri == "" && isHttpUrl(renderReply.Id) {
+			renderReply.HtmlUri = renderReply.Id
+		}
+
+		converted = append(converted, renderReply)
+		byId[renderReply.Id] = renderReply
+	}
+
+	tree := []*ActivityPubObject{}
+
+	for _, reply := range converted {
+		parent, exists := byId[reply.InReplyTo]
+		if exists && parent != reply {
+			parent.Replies = append(parent.Replies, reply)
+		} else {
+			tree = append(tree, reply)
+		}
+	}
+
+	return tree, nil
+}
+
+// getRepliesCollection builds the replies collection published on an entry,
+// which lists the direct replies to it.
+func getRepliesCollection(db *SqliteDatabase, domain string, entryId int) (*activitypub.OrderedCollection, error) {
+
+	replies, err := db.GetReplies(domain, entryId)
+	if err != nil {
+		return nil, err
+	}
+
+	repliesId := activitypub.IRI(fmt.Sprintf("https://%s/%d/replies.jsonld", domain, entryId))
+	collection := activitypub.OrderedCollectionNew(repliesId)
+
+	for _, reply := range replies {
+		parentId, ok := getLocalEntryId(domain, activitypub.IRI(reply.InReplyTo))
+		if ok && parentId == entryId {
+			collection.OrderedItems = append(collection.OrderedItems, activitypub.IRI(reply.Id))
+		}
+	}
+
+	collection.TotalItems = uint(len(collection.OrderedItems))
+
+	return collection, nil
+}
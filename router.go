@@ -0,0 +1,72 @@
+package syndicat
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// hostRouter picks a handler by the host a request was made to, and answers
+// hosts it doesn't know with a 404. When a request comes through one of the
+// trusted proxies, the host is taken from X-Forwarded-Host instead, which
+// http.ServeMux host patterns wouldn't do.
+type hostRouter struct {
+	hosts          map[string]http.Handler
+	trustedProxies []string
+}
+
+func newHostRouter(trustedProxies []string) *hostRouter {
+	return &hostRouter{
+		hosts:          make(map[string]http.Handler),
+		trustedProxies: trustedProxies,
+	}
+}
+
+// Handle routes every request for host to handler.
+func (h *hostRouter) Handle(host string, handler http.Handler) {
+	h.hosts[host] = handler
+}
+
+func (h *hostRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	// Nothing after this should ever see the header, so that getHost can't
+	// be fooled by a client setting it
+	forwardedHost := r.Header.Get("X-Forwarded-Host")
+	r.Header.Del("X-Forwarded-Host")
+
+	if forwardedHost != "" && h.isTrustedProxy(r.RemoteAddr) {
+		// Proxies in a chain each append the host they saw
+		r.Host = strings.TrimSpace(strings.Split(forwardedHost, ",")[0])
+	}
+
+	handler, exists := h.hosts[getHost(r)]
+	if !exists {
+		w.WriteHeader(404)
+		io.WriteString(w, "Unknown host")
+		return
+	}
+
+	handler.ServeHTTP(w, r)
+}
+
+func (h *hostRouter) isTrustedProxy(remoteAddr string) bool {
+
+	remoteHost, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		remoteHost = remoteAddr
+	}
+
+	remoteIp := net.ParseIP(remoteHost)
+	if remoteIp == nil {
+		return false
+	}
+
+	for _, proxy := range h.trustedProxies {
+		if remoteIp.Equal(net.ParseIP(proxy)) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,177 @@
+package syndicat
+
+import (
+	"database/sql"
+	"errors"
+	"net/url"
+
+	"github.com/go-ap/activitypub"
+	"github.com/go-ap/client"
+)
+
+// getInboxRecipients works out which of our hosted domains an activity
+// delivered to the shared inbox is meant for. Remote servers send a single
+// copy for all of our actors, so this goes by the addressing, by what the
+// activity refers to, and by who follows whom.
+func getInboxRecipients(db *SqliteDatabase, apClient *client.C, sourceDir string, act *activitypub.Activity) ([]string, error) {
+
+	domains := []string{}
+
+	addDomain := func(iri activitypub.IRI) {
+		parsedUri, err := url.Parse(string(iri))
+		if err != nil {
+			return
+		}
+
+		if isHostedDomain(sourceDir, parsedUri.Host) && !stringInArray(parsedUri.Host, domains) {
+			domains = append(domains, parsedUri.Host)
+		}
+	}
+
+	addDomains := func(newDomains []string) {
+		for _, domain := range newDomains {
+			if isHostedDomain(sourceDir, domain) && !stringInArray(domain, domains) {
+				domains = append(domains, domain)
+			}
+		}
+	}
+
+	actorId := act.Actor.GetID()
+
+	addressed := activitypub.ItemCollection{}
+	addressed = append(addressed, act.To...)
+	addressed = append(addressed, act.CC...)
+	addressed = append(addressed, act.Bto...)
+	addressed = append(addressed, act.BCC...)
+	addressed = append(addressed, act.Audience...)
+
+	var obj *activitypub.Object
+	if act.Object != nil && !activitypub.IsIRI(act.Object) {
+		obj, _ = activitypub.ToObject(act.Object)
+	}
+
+	// Some servers only address the object, not the activity wrapping it
+	if obj != nil {
+		addressed = append(addressed, obj.To...)
+		addressed = append(addressed, obj.CC...)
+		addressed = append(addressed, obj.Bto...)
+		addressed = append(addressed, obj.BCC...)
+		addressed = append(addressed, obj.Audience...)
+	}
+
+	// The signature was checked against this actor, so it's already cached
+	actor, err := getActor(apClient, actorId)
+	if err != nil {
+		return nil, err
+	}
+
+	followersAddressed := false
+
+	for _, recipient := range addressed {
+		if recipient == nil {
+			continue
+		}
+
+		iri := recipient.GetLink()
+		if iri == activitypub.PublicNS {
+			continue
+		}
+
+		// Anything on one of our domains, ie an actor or its followers
+		// collection
+		addDomain(iri)
+
+		if actor.Followers != nil && actor.Followers.GetLink() == iri {
+			followersAddressed = true
+		}
+	}
+
+	if followersAddressed {
+		followingDomains, err := db.GetFollowingDomains(string(actorId), FollowingStatusAccepted)
+		if err != nil {
+			return nil, err
+		}
+
+		addDomains(followingDomains)
+	}
+
+	if act.Object == nil {
+		return domains, nil
+	}
+
+	objectId := act.Object.GetLink()
+
+	// Likes, Announces, Follows and Accepts all point at something of ours
+	addDomain(objectId)
+
+	// Undo wraps the activity being undone, which points at something of
+	// ours in the same way
+	if undone, err := activitypub.ToActivity(act.Object); err == nil && act.Type == activitypub.UndoType && undone.Object != nil {
+		addDomain(undone.Object.GetLink())
+	}
+
+	// An Undo which only has the IRI of the activity being undone is looked
+	// up in the reactions and Follows we've stored
+	if act.Type == activitypub.UndoType && activitypub.IsIRI(act.Object) {
+		reaction, err := db.GetReaction(string(objectId))
+		if err == nil {
+			addDomains([]string{reaction.Domain})
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+
+		followedDomains, err := db.GetFollowedDomains(string(actorId))
+		if err != nil {
+			return nil, err
+		}
+
+		addDomains(followedDomains)
+
+		requestDomains, err := db.GetFollowRequestDomains(string(actorId))
+		if err != nil {
+			return nil, err
+		}
+
+		addDomains(requestDomains)
+	}
+
+	// Actors deleting or updating themselves concern everyone they're
+	// connected to
+	if objectId == actorId {
+		followedDomains, err := db.GetFollowedDomains(string(actorId))
+		if err != nil {
+			return nil, err
+		}
+
+		addDomains(followedDomains)
+
+		followingDomains, err := db.GetFollowingDomains(string(actorId), FollowingStatusAccepted)
+		if err != nil {
+			return nil, err
+		}
+
+		addDomains(followingDomains)
+	}
+
+	// Replies further down a thread, and updates or deletes of replies we
+	// already have, belong to the domain with the thread
+	replyIds := []activitypub.IRI{objectId}
+	if obj != nil && obj.InReplyTo != nil {
+		addDomain(obj.InReplyTo.GetLink())
+		replyIds = append(replyIds, obj.InReplyTo.GetLink())
+	}
+
+	for _, replyId := range replyIds {
+		reply, err := db.GetReply(string(replyId))
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		addDomains([]string{reply.Domain})
+	}
+
+	return domains, nil
+}
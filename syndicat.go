@@ -2,16 +2,21 @@ package syndicat
 
 import (
 	"bytes"
+	"context"
+	"crypto/rsa"
+	"database/sql"
 	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/anderspitman/treemess-go"
@@ -27,26 +32,74 @@ type ServerConfig struct {
 	RootUri      string
 	TemplatesDir string
 	Port         int
+	// Require ActivityPub objects to be fetched with an HTTP Signature, so
+	// blocked actors and domains can be refused
+	AuthorizedFetch bool
+	// Addresses of the reverse proxies allowed to set X-Forwarded-Host.
+	// It's ignored from anyone else.
+	TrustedProxies []string
+	// Where the database and the hosted files live. Default to
+	// entree_db.sqlite and files in the working directory.
+	DbPath   string
+	FilesDir string
 }
 
-type Server struct{}
+// How long Start waits for requests and deliveries to finish once its
+// context is canceled
+const shutdownTimeout = 30 * time.Second
+
+// Server serves the hosted domains and delivers their activities. Use Start
+// to listen on the configured port, or ServeHTTP to embed it in another
+// server.
+type Server struct {
+	conf          ServerConfig
+	db            *SqliteDatabase
+	privKey       *rsa.PrivateKey
+	pubKeyId      string
+	deliveryQueue *DeliveryQueue
+	handler       http.Handler
+	httpServer    *http.Server
+
+	mut          sync.Mutex
+	stopDelivery context.CancelFunc
+	deliveryDone chan struct{}
+	done         chan struct{}
+	closed       bool
+	// Requests being handled, whether they came through Start or ServeHTTP
+	requests sync.WaitGroup
+}
+
+var errServerClosed = errors.New("Server is shut down")
 
 //go:embed templates
 var fs embed.FS
 
-func NewServer(conf ServerConfig) *Server {
+func NewServer(conf ServerConfig) (*Server, error) {
 
 	rootUri := conf.RootUri
 	authUri := "auth." + rootUri
-	fsDir := "files"
+	fsDir := conf.FilesDir
+	if fsDir == "" {
+		fsDir = "files"
+	}
 	sourceDir := fsDir
 	serveDir := fsDir
 	//userSourceDir := filepath.Join(serveDir, rootUri)
 	//userServeDir := userSourceDir
 
-	db, err := NewDatabase("entree_db.sqlite")
+	dbPath := conf.DbPath
+	if dbPath == "" {
+		dbPath = "entree_db.sqlite"
+	}
+
+	db, err := NewDatabase(dbPath)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.AssignLegacyTags(rootUri)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
 	printJson(db)
@@ -60,11 +113,40 @@ func NewServer(conf ServerConfig) *Server {
 	//sourceDir := filepath.Join(fsDir, "source")
 	//serveDir := filepath.Join(fsDir, "serve")
 
+	privPemPath := filepath.Join(sourceDir, rootUri, "private_key.pem")
+	_, err = os.Stat(privPemPath)
+	if err != nil {
+		privKey, err := MakeRSAKey()
+		if err != nil {
+			return nil, err
+		}
+
+		err = SaveRSAKey(privPemPath, privKey)
+		if err != nil {
+			return nil, err
+		}
+
+	}
+
+	privKey, err := LoadRSAKey(privPemPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// The main domain is hosted like any other once it has a key
+	domains, err := getHostedDomains(sourceDir)
+	if err != nil {
+		return nil, err
+	}
+
+	domainMap := map[string]string{}
+	for _, domain := range domains {
+		domainMap[domain] = fmt.Sprintf("/%s", domain)
+	}
+
 	gdConfig := &gemdrive.Config{
-		Dirs: []string{fsDir},
-		DomainMap: map[string]string{
-			rootUri: fmt.Sprintf("/%s", rootUri),
-		},
+		Dirs:      []string{fsDir},
+		DomainMap: domainMap,
 	}
 
 	tmess := treemess.NewTreeMess()
@@ -72,7 +154,7 @@ func NewServer(conf ServerConfig) *Server {
 
 	gdServer, err := gemdrive.NewServer(gdConfig, gdTmess)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
 	ch := make(chan treemess.Message)
@@ -80,33 +162,27 @@ func NewServer(conf ServerConfig) *Server {
 
 	//tmess.Send("start", nil)
 
+	// Closed by Shutdown
+	done := make(chan struct{})
+
 	go func() {
-		for msg := range ch {
-			fmt.Println(msg)
+		for {
+			select {
+			case msg := <-ch:
+				fmt.Println(msg)
+			case <-done:
+				return
+			}
 		}
 	}()
 
-	privPemPath := filepath.Join(sourceDir, rootUri, "private_key.pem")
-	_, err = os.Stat(privPemPath)
-	if err != nil {
-		privKey, err := MakeRSAKey()
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		err = SaveRSAKey(privPemPath, privKey)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-	}
+	pubKeyId := fmt.Sprintf("https://%s/ap.jsonld#main-key", rootUri)
 
-	privKey, err := LoadRSAKey(privPemPath)
-	if err != nil {
-		log.Fatal(err)
+	httpClient := &http.Client{
+		Timeout: 30 * time.Second,
 	}
 
-	pubKeyId := fmt.Sprintf("https://%s/ap.jsonld#main-key", rootUri)
+	deliveryQueue := NewDeliveryQueue(db, httpClient, sourceDir, rootUri)
 
 	apClient := client.New()
 	apClient.SignFn(func(r *http.Request) error {
@@ -177,11 +253,39 @@ func NewServer(conf ServerConfig) *Server {
 	//	check(err)
 	//}
 
-	httpClient := &http.Client{}
-
 	partialProvider := NewPartialProvider(fs)
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	// Routes are collected here, and each hosted domain gets a mux of its
+	// own with them once they're all in
+	type route struct {
+		pattern string
+		handler http.HandlerFunc
+	}
+	routes := []route{}
+	handleFunc := func(pattern string, handler http.HandlerFunc) {
+		routes = append(routes, route{pattern: pattern, handler: handler})
+	}
+
+	isLoggedIn := func(r *http.Request) bool {
+		_, err := authServer.Validate(r)
+		return err == nil
+	}
+
+	// checkAuth sends users who aren't logged in to the auth server, and
+	// returns false if it did so
+	checkAuth := func(w http.ResponseWriter, r *http.Request) bool {
+		if !isLoggedIn(r) {
+			redirectUri := url.QueryEscape(fmt.Sprintf("https://%s%s", getHost(r), r.URL.Path))
+			authUrl := fmt.Sprintf("https://%s/auth?client_id=%s&redirect_uri=%s&response_type=code&state=&scope=",
+				authUri, redirectUri, redirectUri)
+			http.Redirect(w, r, authUrl, 307)
+			return false
+		}
+
+		return true
+	}
+
+	handleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 
 		//printJson(r.URL)
 		//printJson(r.Header)
@@ -195,64 +299,274 @@ func NewServer(conf ServerConfig) *Server {
 
 		host := getHost(r)
 
-		switch host {
-		case rootUri:
+		// The actor and entries can be fetched as ActivityPub from the
+		// same URLs as their HTML, which is what Mastodon does with
+		// URLs pasted into its search
+		jsonPath, negotiable := getActivityJsonPath(r.URL.Path)
+		if negotiable {
+			w.Header().Add("Vary", "Accept")
+		}
+		serveJson := negotiable && wantsActivityJson(r)
+
+		// Asking for the JSON files directly shouldn't get around
+		// authorized fetch. The actor has to stay public though, since
+		// it has the key that signatures are checked against.
+		isApFetch := wantsActivityJson(r) || strings.HasSuffix(r.URL.Path, ".jsonld")
+		isActorFetch := r.URL.Path == "/ap.jsonld" || (serveJson && jsonPath == "/ap.jsonld")
+		signatureRequired := conf.AuthorizedFetch && isApFetch && !isActorFetch
+
+		var signer activitypub.IRI
+		if signatureRequired || r.Header.Get("Signature") != "" {
+			verifiedSigner, err := verifyRequest(apClient, r, nil)
+			if err != nil {
+				w.WriteHeader(401)
+				io.WriteString(w, err.Error())
+				return
+			}
+
+			signer = verifiedSigner
+
+			blocked, err := db.IsBlocked(host, string(signer))
+			if err != nil {
+				w.WriteHeader(500)
+				io.WriteString(w, err.Error())
+				return
+			}
+
+			if blocked {
+				w.WriteHeader(403)
+				return
+			}
+		}
+
+		tombstoneBytes, deleted := getTombstone(serveDir, host, r.URL.Path)
+		if deleted {
+			if strings.HasSuffix(r.URL.Path, ".jsonld") || strings.Contains(r.Header.Get("Accept"), "json") {
+				w.Header().Set("Content-Type", "application/activity+json")
+				w.WriteHeader(410)
+				w.Write(tombstoneBytes)
+			} else {
+				w.Header().Set("Content-Type", "text/html")
+				w.WriteHeader(410)
+				io.WriteString(w, "This entry has been deleted")
+			}
+			return
+		}
+
+		privateEntry, isPrivate := getPrivateEntry(sourceDir, host, r.URL.Path)
+		if isPrivate {
+			// Remote servers fetch with a signature, while we're
+			// logged in when browsing
+			if signer != "" {
+				allowed, err := canAccessEntry(db, host, privateEntry, signer)
+				if err != nil {
+					w.WriteHeader(500)
+					io.WriteString(w, err.Error())
+					return
+				}
+
+				// Same as Mastodon, this doesn't give away that the
+				// entry exists
+				if !allowed {
+					w.WriteHeader(404)
+					return
+				}
+			} else if !checkAuth(w, r) {
+				return
+			}
+		}
+
+		if serveJson {
+			jsonBytes, err := os.ReadFile(filepath.Join(serveDir, host, jsonPath))
+			if errors.Is(err, os.ErrNotExist) {
+				w.WriteHeader(404)
+				return
+			}
+			if err != nil {
+				w.WriteHeader(500)
+				io.WriteString(w, err.Error())
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/activity+json")
+			w.Write(jsonBytes)
+			return
+		}
+
+		// The editor and the edit controls on entries are only for
+		// us, so they're rendered here instead of being published
+		entryId, entryPage, isEntry := getEntryPage(r.URL.Path)
+		showEditor := isEntry && entryPage == "edit"
+		showControls := isEntry && entryPage == "" && isLoggedIn(r)
+		if showEditor || showControls {
+			if showEditor && !checkAuth(w, r) {
+				return
+			}
+
+			_, entry, err := readEntryActivity(filepath.Join(sourceDir, host, strconv.Itoa(entryId)))
+			if errors.Is(err, os.ErrNotExist) {
+				w.WriteHeader(404)
+				return
+			}
+			if err != nil {
+				w.WriteHeader(500)
+				io.WriteString(w, err.Error())
+				return
+			}
+
+			var html string
+			if showEditor {
+				html, err = renderEntryEditor(host, entryId, entry, partialProvider)
+			} else {
+				html, err = renderEntryPage(db, host, entryId, entry, true, partialProvider)
+			}
+			if err != nil {
+				w.WriteHeader(500)
+				io.WriteString(w, err.Error())
+				return
+			}
+
+			w.Header().Set("Content-Type", "text/html")
+			io.WriteString(w, html)
+			return
+		}
+
+		//validation, err := authServer.Validate(r)
+		//if err != nil {
+		//	redirectUri := "https://" + rootUri
+		//	url := fmt.Sprintf("https://%s/auth?client_id=%s&redirect_uri=%s&response_type=code&state=&scope=",
+		//		authUri, redirectUri, redirectUri)
+		//	http.Redirect(w, r, url, 307)
+		//	return
+		//}
+		gdServer.ServeHTTP(w, r)
+	})
+
+	handleFunc("/.well-known/webfinger", func(w http.ResponseWriter, r *http.Request) {
+
+		resource := r.URL.Query().Get("resource")
+		if resource == "" {
+			w.WriteHeader(400)
+			io.WriteString(w, "Missing resource parameter")
+			return
+		}
+
+		account, err := getWebFingerAccount(sourceDir, resource)
+		if errors.Is(err, errWebFingerNotFound) {
+			w.WriteHeader(404)
+			io.WriteString(w, err.Error())
+			return
+		}
+		if err != nil {
+			w.WriteHeader(400)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/jrd+json")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		json.NewEncoder(w).Encode(account)
+	})
+
+	handleFunc("/.well-known/nodeinfo", func(w http.ResponseWriter, r *http.Request) {
+
+		host := getHost(r)
+
+		if !isHostedDomain(sourceDir, host) {
+			w.WriteHeader(404)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		json.NewEncoder(w).Encode(getNodeInfoDiscovery(host))
+	})
+
+	handleFunc("/nodeinfo/", func(w http.ResponseWriter, r *http.Request) {
 
-			//validation, err := authServer.Validate(r)
-			//if err != nil {
-			//	redirectUri := "https://" + rootUri
-			//	url := fmt.Sprintf("https://%s/auth?client_id=%s&redirect_uri=%s&response_type=code&state=&scope=",
-			//		authUri, redirectUri, redirectUri)
-			//	http.Redirect(w, r, url, 307)
-			//	return
-			//}
-			gdServer.ServeHTTP(w, r)
+		host := getHost(r)
+
+		if !isHostedDomain(sourceDir, host) {
+			w.WriteHeader(404)
 			return
-		case authUri:
-			authServer.ServeHTTP(w, r)
+		}
+
+		version := strings.TrimPrefix(r.URL.Path, "/nodeinfo/")
+
+		nodeInfo, err := getNodeInfo(sourceDir, host, version)
+		if err != nil {
+			w.WriteHeader(404)
+			io.WriteString(w, err.Error())
 			return
 		}
+
+		contentType := fmt.Sprintf(`application/json; profile="%s%s#"`, nodeInfoSchemaBase, version)
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		json.NewEncoder(w).Encode(nodeInfo)
 	})
 
-	http.HandleFunc("/debug", func(w http.ResponseWriter, r *http.Request) {
+	handleFunc("/debug", func(w http.ResponseWriter, r *http.Request) {
+
+		if !checkAuth(w, r) {
+			return
+		}
+
 		r.ParseForm()
 
 		uri := r.Form.Get("uri")
 
 		req, err := http.NewRequest("GET", uri, nil)
 		if err != nil {
-			log.Fatal(err)
+			w.WriteHeader(400)
+			io.WriteString(w, err.Error())
+			return
 		}
 
-		parsedUrl, err := url.Parse(uri)
-		check(err)
-
 		dateHeader := time.Now().UTC().Format(http.TimeFormat)
 
 		printJson(req.Header)
 		req.Header.Set("Accept", "application/activity+json")
 		req.Header.Set("Date", dateHeader)
-		req.Header.Set("Host", parsedUrl.Host)
+		req.Header.Set("Host", req.URL.Host)
 		printJson(req.Header)
 
 		err = sign(privKey, pubKeyId, req)
-		check(err)
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
 
 		printJson(req.Header)
 
 		resp, err := httpClient.Do(req)
-		check(err)
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+		defer resp.Body.Close()
 
 		printJson(req)
 		fmt.Println(resp.StatusCode)
 		body, err := io.ReadAll(resp.Body)
-		check(err)
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
 		fmt.Println(string(body))
 
 		http.Redirect(w, r, "/entry-editor/", http.StatusSeeOther)
 	})
 
-	http.HandleFunc("/get-object", func(w http.ResponseWriter, r *http.Request) {
+	handleFunc("/get-object", func(w http.ResponseWriter, r *http.Request) {
+
+		if !checkAuth(w, r) {
+			return
+		}
+
 		r.ParseForm()
 
 		uri := activitypub.IRI(r.Form.Get("uri"))
@@ -269,7 +583,12 @@ func NewServer(conf ServerConfig) *Server {
 		http.Redirect(w, r, "/entry-editor/", http.StatusSeeOther)
 	})
 
-	http.HandleFunc("/get-tree", func(w http.ResponseWriter, r *http.Request) {
+	handleFunc("/get-tree", func(w http.ResponseWriter, r *http.Request) {
+
+		if !checkAuth(w, r) {
+			return
+		}
+
 		r.ParseForm()
 
 		uri := activitypub.IRI(r.Form.Get("uri"))
@@ -281,9 +600,7 @@ func NewServer(conf ServerConfig) *Server {
 			return
 		}
 
-		printJson(tree)
-
-		followersBytes, err := jsonld.WithContext(
+		treeBytes, err := jsonld.WithContext(
 			jsonld.IRI(activitypub.ActivityBaseURI),
 		).Marshal(tree)
 		if err != nil {
@@ -293,92 +610,420 @@ func NewServer(conf ServerConfig) *Server {
 			return
 		}
 
-		err = os.WriteFile("debug.json", followersBytes, 0644)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(treeBytes)
+	})
+
+	handleFunc("/deliveries", func(w http.ResponseWriter, r *http.Request) {
+
+		if !checkAuth(w, r) {
+			return
+		}
+
+		deliveries, err := db.GetDeliveries()
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		type deliveryData struct {
+			*Delivery
+			NextAttemptText string
+		}
+
+		pending := []*deliveryData{}
+		failed := []*deliveryData{}
+
+		for _, delivery := range deliveries {
+			d := &deliveryData{
+				Delivery:        delivery,
+				NextAttemptText: delivery.NextAttempt.Format(time.RFC3339),
+			}
+
+			if delivery.Status == DeliveryStatusFailed {
+				failed = append(failed, d)
+			} else {
+				pending = append(pending, d)
+			}
+		}
+
+		tmplData := struct {
+			Pending  []*deliveryData
+			Failed   []*deliveryData
+			LoggedIn bool
+		}{
+			Pending:  pending,
+			Failed:   failed,
+			LoggedIn: true,
+		}
+
+		html, err := renderTemplate("templates/deliveries.html", tmplData, partialProvider)
 		if err != nil {
-			fmt.Println(err.Error())
 			w.WriteHeader(500)
 			io.WriteString(w, err.Error())
 			return
 		}
 
-		http.Redirect(w, r, "/entry-editor/", http.StatusSeeOther)
+		w.Header().Set("Content-Type", "text/html")
+		io.WriteString(w, html)
 	})
 
-	http.HandleFunc("/inbox", func(w http.ResponseWriter, r *http.Request) {
+	handleFunc("/timeline", func(w http.ResponseWriter, r *http.Request) {
+
+		if !checkAuth(w, r) {
+			return
+		}
+
 		host := getHost(r)
 
-		body, err := io.ReadAll(r.Body)
+		entries, err := getTimeline(db, host)
 		if err != nil {
 			w.WriteHeader(500)
 			io.WriteString(w, err.Error())
 			return
 		}
 
-		fmt.Println(string(body))
-		var act *activitypub.Activity
-		err = json.Unmarshal(body, &act)
+		tmplData := struct {
+			Entries  []*timelineEntry
+			LoggedIn bool
+		}{
+			Entries:  entries,
+			LoggedIn: true,
+		}
+
+		html, err := renderTemplate("templates/timeline.html", tmplData, partialProvider)
 		if err != nil {
 			w.WriteHeader(500)
 			io.WriteString(w, err.Error())
 			return
 		}
 
-		//var obj *activitypub.Object
-		//err = json.NewDecoder(r.Body).Decode(&obj)
-		//if err != nil {
-		//	w.WriteHeader(500)
-		//	io.WriteString(w, err.Error())
-		//	return
-		//}
-
-		fmt.Println("/inbox")
-		printJson(act)
-
-		switch act.Type {
-		case activitypub.FollowType:
-			followersPath := filepath.Join(serveDir, host, "followers.jsonld")
+		w.Header().Set("Content-Type", "text/html")
+		io.WriteString(w, html)
+	})
 
-			followersBytes, err := os.ReadFile(followersPath)
-			if err != nil {
-				w.WriteHeader(500)
-				io.WriteString(w, err.Error())
-				return
-			}
+	handleFunc("/blocks", func(w http.ResponseWriter, r *http.Request) {
 
-			var followers *activitypub.OrderedCollection
-			err = json.Unmarshal(followersBytes, &followers)
-			if err != nil {
-				w.WriteHeader(500)
-				io.WriteString(w, err.Error())
-				return
-			}
+		if !checkAuth(w, r) {
+			return
+		}
 
-			// TODO: using GetID() because it was panicking with a weird error when type asserting
-			// act.Actor.(activitypub.IRI)
-			newFollower := act.Actor.GetID()
+		host := getHost(r)
 
-			for _, f := range followers.OrderedItems {
-				follower := f.(activitypub.IRI)
-				if newFollower == follower {
-					// already exists, noop
-					return
-				}
-			}
+		blocks, err := db.GetBlocks(host)
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
 
-			followers.OrderedItems = append(followers.OrderedItems, newFollower)
-			followers.TotalItems = followers.TotalItems + 1
+		tmplData := struct {
+			Blocks   []*Block
+			LoggedIn bool
+		}{
+			Blocks:   blocks,
+			LoggedIn: true,
+		}
 
-			followersBytes, err = jsonld.WithContext(
-				jsonld.IRI(activitypub.ActivityBaseURI),
-			).Marshal(followers)
-			if err != nil {
-				fmt.Println(err.Error())
+		html, err := renderTemplate("templates/blocks.html", tmplData, partialProvider)
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html")
+		io.WriteString(w, html)
+	})
+
+	handleFunc("/blocks/add", func(w http.ResponseWriter, r *http.Request) {
+
+		if !checkAuth(w, r) {
+			return
+		}
+
+		r.ParseForm()
+
+		host := getHost(r)
+
+		target, err := resolveBlockTarget(httpClient, r.Form.Get("target"))
+		if err != nil {
+			w.WriteHeader(400)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		blockAct, inbox, err := block(db, apClient, serveDir, host, target, r.Form.Get("send_block") == "on")
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		if blockAct != nil {
+			err = deliveryQueue.Enqueue(host, blockAct, []string{inbox})
+			if err != nil {
 				w.WriteHeader(500)
 				io.WriteString(w, err.Error())
 				return
 			}
+		}
+
+		http.Redirect(w, r, "/blocks", http.StatusSeeOther)
+	})
+
+	handleFunc("/blocks/remove", func(w http.ResponseWriter, r *http.Request) {
+
+		if !checkAuth(w, r) {
+			return
+		}
+
+		r.ParseForm()
+
+		host := getHost(r)
+
+		err := db.DeleteBlock(host, r.Form.Get("target"))
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		http.Redirect(w, r, "/blocks", http.StatusSeeOther)
+	})
+
+	handleFunc("/blocks/import", func(w http.ResponseWriter, r *http.Request) {
+
+		if !checkAuth(w, r) {
+			return
+		}
+
+		host := getHost(r)
+
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			w.WriteHeader(400)
+			io.WriteString(w, err.Error())
+			return
+		}
+		defer file.Close()
+
+		targets, err := parseBlocksCsv(file)
+		if err != nil {
+			w.WriteHeader(400)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		for _, target := range targets {
+			// One bad line shouldn't stop the rest of the list from
+			// being imported
+			resolved, err := resolveBlockTarget(httpClient, target)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to import block of %s: %s\n", target, err.Error())
+				continue
+			}
 
-			err = os.WriteFile(followersPath, followersBytes, 0644)
+			_, _, err = block(db, apClient, serveDir, host, resolved, false)
+			if err != nil {
+				w.WriteHeader(500)
+				io.WriteString(w, err.Error())
+				return
+			}
+		}
+
+		http.Redirect(w, r, "/blocks", http.StatusSeeOther)
+	})
+
+	handleFunc("/blocks/domain_blocks.csv", func(w http.ResponseWriter, r *http.Request) {
+
+		if !checkAuth(w, r) {
+			return
+		}
+
+		host := getHost(r)
+
+		blocks, err := db.GetBlocks(host)
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		csvBytes, err := getDomainBlocksCsv(blocks)
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/csv")
+		w.Write(csvBytes)
+	})
+
+	handleFunc("/blocks/blocked_accounts.csv", func(w http.ResponseWriter, r *http.Request) {
+
+		if !checkAuth(w, r) {
+			return
+		}
+
+		host := getHost(r)
+
+		blocks, err := db.GetBlocks(host)
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		csvBytes, err := getAccountBlocksCsv(apClient, blocks)
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/csv")
+		w.Write(csvBytes)
+	})
+
+	handleFunc("/follow-requests", func(w http.ResponseWriter, r *http.Request) {
+
+		if !checkAuth(w, r) {
+			return
+		}
+
+		host := getHost(r)
+
+		requests, err := db.GetFollowRequests(host)
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		tmplData := struct {
+			FollowRequests []*FollowRequest
+			LoggedIn       bool
+		}{
+			FollowRequests: requests,
+			LoggedIn:       true,
+		}
+
+		html, err := renderTemplate("templates/follow-requests.html", tmplData, partialProvider)
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html")
+		io.WriteString(w, html)
+	})
+
+	handleFollowRequest := func(w http.ResponseWriter, r *http.Request, approve bool) {
+
+		if !checkAuth(w, r) {
+			return
+		}
+
+		r.ParseForm()
+
+		host := getHost(r)
+
+		answer, inbox, err := decideFollowRequest(db, apClient, serveDir, host, r.Form.Get("actor"), approve)
+		if errors.Is(err, sql.ErrNoRows) {
+			w.WriteHeader(404)
+			io.WriteString(w, "No such follow request")
+			return
+		}
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		err = deliveryQueue.Enqueue(host, answer, []string{inbox})
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		http.Redirect(w, r, "/follow-requests", http.StatusSeeOther)
+	}
+
+	handleFunc("/follow-requests/approve", func(w http.ResponseWriter, r *http.Request) {
+		handleFollowRequest(w, r, true)
+	})
+
+	handleFunc("/follow-requests/reject", func(w http.ResponseWriter, r *http.Request) {
+		handleFollowRequest(w, r, false)
+	})
+
+	// handleInbox processes an incoming activity for each of the hosted
+	// domains it's meant for. A personal inbox only takes activities for its
+	// own domain, while the shared inbox works them out from the activity.
+	handleInbox := func(w http.ResponseWriter, r *http.Request, shared bool) {
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		signer, err := verifyRequest(apClient, r, body)
+		if err != nil {
+			w.WriteHeader(401)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		fmt.Println(string(body))
+		var act *activitypub.Activity
+		err = json.Unmarshal(body, &act)
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		if act.Actor == nil || act.Actor.GetID() != signer {
+			w.WriteHeader(401)
+			io.WriteString(w, "Activity actor does not match signature")
+			return
+		}
+
+		//var obj *activitypub.Object
+		//err = json.NewDecoder(r.Body).Decode(&obj)
+		//if err != nil {
+		//	w.WriteHeader(500)
+		//	io.WriteString(w, err.Error())
+		//	return
+		//}
+
+		fmt.Println(r.URL.Path)
+		printJson(act)
+
+		domains := []string{getHost(r)}
+		if shared {
+			domains, err = getInboxRecipients(db, apClient, sourceDir, act)
+			if err != nil {
+				fmt.Println(err.Error())
+				w.WriteHeader(500)
+				io.WriteString(w, err.Error())
+				return
+			}
+		}
+
+		// Rendering covers every domain, so it only needs doing once
+		needsRender := false
+
+		for _, host := range domains {
+
+			blocked, err := db.IsBlocked(host, string(act.Actor.GetID()))
 			if err != nil {
 				fmt.Println(err.Error())
 				w.WriteHeader(500)
@@ -386,12 +1031,312 @@ func NewServer(conf ServerConfig) *Server {
 				return
 			}
 
-			accept := &activitypub.Accept{
-				Type:   activitypub.AcceptType,
-				Object: act,
+			// Blocked actors can still clean up after themselves, but
+			// nothing new from them gets in
+			if blocked {
+				switch act.Type {
+				case activitypub.FollowType:
+					reject, inbox, err := rejectFollow(apClient, host, act)
+					if err != nil {
+						fmt.Println(err.Error())
+						w.WriteHeader(500)
+						io.WriteString(w, err.Error())
+						return
+					}
+
+					err = deliveryQueue.Enqueue(host, reject, []string{inbox})
+					if err != nil {
+						fmt.Println(err.Error())
+						w.WriteHeader(500)
+						io.WriteString(w, err.Error())
+						return
+					}
+
+					continue
+				case activitypub.CreateType, activitypub.LikeType, activitypub.AnnounceType:
+					continue
+				}
 			}
 
-			err = sendActivity(httpClient, privKey, pubKeyId, accept, "https://mastodon.social/inbox")
+			switch act.Type {
+			case activitypub.FollowType:
+				profile, err := loadProfile(filepath.Join(sourceDir, host))
+				if err != nil {
+					fmt.Println(err.Error())
+					w.WriteHeader(500)
+					io.WriteString(w, err.Error())
+					return
+				}
+
+				// Existing followers are accepted again in case they
+				// lost track of our first Accept
+				_, err = db.GetFollower(host, string(act.Actor.GetID()))
+				if err != nil && !errors.Is(err, sql.ErrNoRows) {
+					fmt.Println(err.Error())
+					w.WriteHeader(500)
+					io.WriteString(w, err.Error())
+					return
+				}
+				isFollower := err == nil
+
+				if profile.ManuallyApprovesFollowers && !isFollower {
+					err = addFollowRequest(db, apClient, host, act)
+					if err != nil {
+						fmt.Println(err.Error())
+						w.WriteHeader(500)
+						io.WriteString(w, err.Error())
+						return
+					}
+					break
+				}
+
+				accept, inbox, err := acceptFollow(db, apClient, serveDir, host, act)
+				if err != nil {
+					fmt.Println(err.Error())
+					w.WriteHeader(500)
+					io.WriteString(w, err.Error())
+					return
+				}
+
+				err = deliveryQueue.Enqueue(host, accept, []string{inbox})
+				if err != nil {
+					fmt.Println(err.Error())
+					w.WriteHeader(500)
+					io.WriteString(w, err.Error())
+					return
+				}
+			case activitypub.AcceptType, activitypub.RejectType:
+				_, err = answerFollow(db, serveDir, host, act)
+				if err != nil {
+					fmt.Println(err.Error())
+					w.WriteHeader(500)
+					io.WriteString(w, err.Error())
+					return
+				}
+			case activitypub.CreateType:
+				obj, err := activitypub.ToObject(act.Object)
+				if err != nil {
+					w.WriteHeader(400)
+					io.WriteString(w, err.Error())
+					return
+				}
+
+				if obj.AttributedTo == nil || obj.AttributedTo.GetLink() != act.Actor.GetID() {
+					w.WriteHeader(403)
+					io.WriteString(w, "Actors can only create their own objects")
+					return
+				}
+
+				if !isSameHost(obj.ID, act.Actor.GetID()) {
+					w.WriteHeader(403)
+					io.WriteString(w, "Objects have to be on the same server as their actor")
+					return
+				}
+
+				isReply, err := addReply(db, sourceDir, host, obj)
+				if err != nil {
+					fmt.Println(err.Error())
+					w.WriteHeader(500)
+					io.WriteString(w, err.Error())
+					return
+				}
+
+				_, err = addTimelineItem(db, apClient, host, obj)
+				if err != nil {
+					fmt.Println(err.Error())
+					w.WriteHeader(500)
+					io.WriteString(w, err.Error())
+					return
+				}
+
+				if isReply {
+					needsRender = true
+				}
+			case activitypub.LikeType, activitypub.AnnounceType:
+				isReaction, err := addReaction(db, apClient, sourceDir, host, act)
+				if err != nil {
+					fmt.Println(err.Error())
+					w.WriteHeader(500)
+					io.WriteString(w, err.Error())
+					return
+				}
+
+				if isReaction {
+					needsRender = true
+				}
+			case activitypub.DeleteType:
+				if act.Object == nil {
+					w.WriteHeader(400)
+					io.WriteString(w, "Missing object")
+					return
+				}
+
+				// The object is usually a Tombstone or an IRI, so all we can
+				// go by is its ID
+				objectId := act.Object.GetLink()
+
+				changed := true
+
+				if objectId == act.Actor.GetID() {
+					err = purgeActor(db, serveDir, objectId)
+				} else {
+					changed, err = deleteReply(db, act.Actor.GetID(), objectId)
+				}
+				if err != nil {
+					fmt.Println(err.Error())
+					w.WriteHeader(500)
+					io.WriteString(w, err.Error())
+					return
+				}
+
+				// The timeline is rendered on request, so this doesn't need a
+				// render
+				err = db.DeleteTimelineItem(string(objectId), string(act.Actor.GetID()))
+				if err != nil {
+					fmt.Println(err.Error())
+					w.WriteHeader(500)
+					io.WriteString(w, err.Error())
+					return
+				}
+
+				if changed {
+					needsRender = true
+				}
+			case activitypub.UpdateType:
+				if act.Object == nil {
+					w.WriteHeader(400)
+					io.WriteString(w, "Missing object")
+					return
+				}
+
+				changed := true
+
+				if act.Object.GetLink() == act.Actor.GetID() {
+					actor, err := activitypub.ToActor(act.Object)
+					if err != nil {
+						w.WriteHeader(400)
+						io.WriteString(w, err.Error())
+						return
+					}
+
+					err = updateActor(db, actor)
+					if err != nil {
+						fmt.Println(err.Error())
+						w.WriteHeader(500)
+						io.WriteString(w, err.Error())
+						return
+					}
+				} else {
+					obj, err := activitypub.ToObject(act.Object)
+					if err != nil {
+						w.WriteHeader(400)
+						io.WriteString(w, err.Error())
+						return
+					}
+
+					if obj.AttributedTo == nil || obj.AttributedTo.GetLink() != act.Actor.GetID() {
+						w.WriteHeader(403)
+						io.WriteString(w, "Actors can only update their own objects")
+						return
+					}
+
+					if !isSameHost(obj.ID, act.Actor.GetID()) {
+						w.WriteHeader(403)
+						io.WriteString(w, "Objects have to be on the same server as their actor")
+						return
+					}
+
+					changed, err = updateReply(db, obj)
+					if err != nil {
+						fmt.Println(err.Error())
+						w.WriteHeader(500)
+						io.WriteString(w, err.Error())
+						return
+					}
+
+					_, err = updateTimelineItem(db, apClient, obj)
+					if err != nil {
+						fmt.Println(err.Error())
+						w.WriteHeader(500)
+						io.WriteString(w, err.Error())
+						return
+					}
+				}
+
+				if changed {
+					needsRender = true
+				}
+			case activitypub.UndoType:
+				if act.Object == nil {
+					w.WriteHeader(400)
+					io.WriteString(w, "Missing object")
+					return
+				}
+
+				var undone *activitypub.Activity
+				if activitypub.IsIRI(act.Object) {
+					undone, err = findUndoneActivity(db, host, act.Actor.GetID(), act.Object.GetLink())
+					if err != nil {
+						fmt.Println(err.Error())
+						w.WriteHeader(500)
+						io.WriteString(w, err.Error())
+						return
+					}
+
+					// Nothing of theirs we know of, so there's nothing
+					// to undo
+					if undone == nil {
+						continue
+					}
+				} else {
+					undone, err = activitypub.ToActivity(act.Object)
+					if err != nil {
+						w.WriteHeader(400)
+						io.WriteString(w, err.Error())
+						return
+					}
+				}
+
+				if undone.Actor == nil || undone.Actor.GetID() != act.Actor.GetID() {
+					w.WriteHeader(403)
+					io.WriteString(w, "Actors can only undo their own activities")
+					return
+				}
+
+				switch undone.Type {
+				case activitypub.FollowType:
+					err = removeFollower(db, serveDir, host, act.Actor.GetID())
+					if err != nil {
+						fmt.Println(err.Error())
+						w.WriteHeader(500)
+						io.WriteString(w, err.Error())
+						return
+					}
+
+					// They might have given up before being approved
+					err = db.DeleteFollowRequest(host, string(act.Actor.GetID()))
+					if err != nil {
+						fmt.Println(err.Error())
+						w.WriteHeader(500)
+						io.WriteString(w, err.Error())
+						return
+					}
+				case activitypub.LikeType, activitypub.AnnounceType:
+					err = db.DeleteReaction(string(undone.ID), string(act.Actor.GetID()))
+					if err != nil {
+						fmt.Println(err.Error())
+						w.WriteHeader(500)
+						io.WriteString(w, err.Error())
+						return
+					}
+
+					needsRender = true
+				}
+			}
+		}
+
+		if needsRender {
+			err = render(db, rootUri, sourceDir, serveDir, partialProvider)
 			if err != nil {
 				fmt.Println(err.Error())
 				w.WriteHeader(500)
@@ -399,15 +1344,37 @@ func NewServer(conf ServerConfig) *Server {
 				return
 			}
 		}
+	}
+
+	handleFunc("/inbox", func(w http.ResponseWriter, r *http.Request) {
+		handleInbox(w, r, false)
+	})
+
+	// Remote servers deliver here once for all of our actors, rather than
+	// once per actor
+	handleFunc("/shared-inbox", func(w http.ResponseWriter, r *http.Request) {
+		handleInbox(w, r, true)
 	})
 
-	http.HandleFunc("/entry-submit", func(w http.ResponseWriter, r *http.Request) {
+	handleFunc("/entry-submit", func(w http.ResponseWriter, r *http.Request) {
+
+		if !checkAuth(w, r) {
+			return
+		}
 
 		r.ParseForm()
 
 		titleText := r.Form.Get("title")
 		entryText := r.Form.Get("entry")
 		parentUri := r.Form.Get("parent_uri")
+		tags := parseTags(entryText, r.Form.Get("tags"))
+
+		visibility, err := ParseVisibility(r.Form.Get("visibility"))
+		if err != nil {
+			w.WriteHeader(400)
+			io.WriteString(w, err.Error())
+			return
+		}
 
 		host := getHost(r)
 
@@ -463,18 +1430,16 @@ func NewServer(conf ServerConfig) *Server {
 			return
 		}
 
+		mentions := getMentions(httpClient, apClient, entryText)
+		contentHtml := linkHashtags(linkMentions(contentHtmlBuf.String(), mentions), host)
+
+		actorId := activitypub.IRI(fmt.Sprintf("https://%s/ap.jsonld", host))
+
 		htmlLink := activitypub.LinkNew("", activitypub.LinkType)
 		htmlLink.Href = activitypub.IRI(entryUri)
 		htmlLink.MediaType = "text/html"
 
-		to := activitypub.ItemCollection{
-			activitypub.IRI("https://www.w3.org/ns/activitystreams#Public"),
-		}
-
-		followersId := activitypub.IRI(fmt.Sprintf("https://%s/followers.jsonld", host))
-		cc := activitypub.ItemCollection{
-			activitypub.IRI(followersId),
-		}
+		to, cc := GetAddressing(host, visibility)
 
 		feedItem := &activitypub.Object{
 			Type: activitypub.NoteType,
@@ -484,10 +1449,10 @@ func NewServer(conf ServerConfig) *Server {
 					Value: []byte(titleText),
 				},
 			},
-			AttributedTo: activitypub.IRI(host),
+			AttributedTo: actorId,
 			Content: activitypub.NaturalLanguageValues{
 				activitypub.LangRefValue{
-					Value: contentHtmlBuf.Bytes(),
+					Value: []byte(contentHtml),
 				},
 			},
 			Source: activitypub.Source{
@@ -506,6 +1471,9 @@ func NewServer(conf ServerConfig) *Server {
 			CC:        cc,
 		}
 
+		addMentions(feedItem, mentions)
+		addHashtags(feedItem, host, tags)
+
 		jsonEntry, err := jsonld.WithContext(
 			jsonld.IRI(activitypub.ActivityBaseURI),
 		).Marshal(feedItem)
@@ -525,9 +1493,9 @@ func NewServer(conf ServerConfig) *Server {
 		activityPath := filepath.Join(entryDir, "activity.jsonld")
 		activityId := activitypub.IRI(fmt.Sprintf("%s%s", entryUri, "activity.jsonld"))
 		activity := activitypub.ActivityNew(activityId, activitypub.CreateType, feedItem)
-		activity.Actor = activitypub.IRI(fmt.Sprintf("https://%s/ap.jsonld", rootUri))
-		activity.To = to
-		activity.CC = cc
+		activity.Actor = actorId
+		activity.To = feedItem.To
+		activity.CC = feedItem.CC
 		activity.Published = feedItem.Published
 
 		activityJsonBytes, err := jsonld.WithContext(
@@ -546,37 +1514,427 @@ func NewServer(conf ServerConfig) *Server {
 			return
 		}
 
-		err = render(rootUri, sourceDir, serveDir, partialProvider)
+		err = db.SetEntryTags(host, entryId, tags)
 		if err != nil {
 			w.WriteHeader(500)
 			io.WriteString(w, err.Error())
 			return
 		}
 
-		//err = sendActivity(httpClient, privKey, pubKeyId, activity, "https://mastodon.social/inbox")
-		//if err != nil {
-		//	fmt.Println(err.Error())
-		//	w.WriteHeader(500)
-		//	io.WriteString(w, err.Error())
-		//	return
-		//}
+		err = render(db, rootUri, sourceDir, serveDir, partialProvider)
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		inboxes, err := getEntryInboxes(db, apClient, host, feedItem, mentions)
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		err = deliveryQueue.Enqueue(host, activity, inboxes)
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		entryUriPath := fmt.Sprintf("/%d/", entryId)
+		http.Redirect(w, r, entryUriPath, http.StatusSeeOther)
+	})
+
+	handleFunc("/follow", func(w http.ResponseWriter, r *http.Request) {
+
+		if !checkAuth(w, r) {
+			return
+		}
+
+		r.ParseForm()
+
+		host := getHost(r)
+
+		actorId, err := resolveHandle(httpClient, r.Form.Get("handle"))
+		if err != nil {
+			w.WriteHeader(400)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		followAct, inbox, err := follow(db, apClient, host, actorId)
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		err = deliveryQueue.Enqueue(host, followAct, []string{inbox})
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		http.Redirect(w, r, "/entry-editor/", http.StatusSeeOther)
+	})
+
+	handleFunc("/entry-update", func(w http.ResponseWriter, r *http.Request) {
+
+		if !checkAuth(w, r) {
+			return
+		}
+
+		r.ParseForm()
+
+		titleText := r.Form.Get("title")
+		entryText := r.Form.Get("entry")
+		parentUri := r.Form.Get("parent_uri")
+		tags := parseTags(entryText, r.Form.Get("tags"))
+
+		visibility, err := ParseVisibility(r.Form.Get("visibility"))
+		if err != nil {
+			w.WriteHeader(400)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		entryId, err := strconv.Atoi(r.Form.Get("entry_id"))
+		if err != nil {
+			w.WriteHeader(400)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		host := getHost(r)
+
+		entryDir := filepath.Join(sourceDir, host, strconv.Itoa(entryId))
+
+		activity, entry, err := readEntryActivity(entryDir)
+		if err != nil {
+			w.WriteHeader(404)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		var contentHtmlBuf bytes.Buffer
+		if err := goldmark.Convert([]byte(entryText), &contentHtmlBuf); err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		mentions := getMentions(httpClient, apClient, entryText)
+
+		entry.Name = activitypub.NaturalLanguageValues{
+			activitypub.LangRefValue{
+				Value: []byte(titleText),
+			},
+		}
+		entry.Content = activitypub.NaturalLanguageValues{
+			activitypub.LangRefValue{
+				Value: []byte(linkHashtags(linkMentions(contentHtmlBuf.String(), mentions), host)),
+			},
+		}
+		entry.Source = activitypub.Source{
+			Content: activitypub.NaturalLanguageValues{
+				activitypub.LangRefValue{
+					Value: []byte(entryText),
+				},
+			},
+			MediaType: "text/markdown",
+		}
+		entry.InReplyTo = activitypub.IRI(parentUri)
+		entry.Updated = time.Now()
+		entry.To, entry.CC = GetAddressing(host, visibility)
+		addMentions(entry, mentions)
+		addHashtags(entry, host, tags)
+
+		activity.To = entry.To
+		activity.CC = entry.CC
+
+		err = writeEntryActivity(entryDir, activity, entry)
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		err = db.SetEntryTags(host, entryId, tags)
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		err = render(db, rootUri, sourceDir, serveDir, partialProvider)
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		updateId := activitypub.IRI(fmt.Sprintf("%s#updates/%d", entry.ID, entry.Updated.UnixNano()))
+		update := activitypub.ActivityNew(updateId, activitypub.UpdateType, entry)
+		update.Actor = entry.AttributedTo
+		update.To = entry.To
+		update.CC = entry.CC
+		update.Published = entry.Updated
+
+		inboxes, err := getEntryInboxes(db, apClient, host, entry, mentions)
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		err = deliveryQueue.Enqueue(host, update, inboxes)
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
 
 		entryUriPath := fmt.Sprintf("/%d/", entryId)
 		http.Redirect(w, r, entryUriPath, http.StatusSeeOther)
 	})
 
-	err = render(rootUri, sourceDir, serveDir, partialProvider)
+	handleFunc("/entry-delete", func(w http.ResponseWriter, r *http.Request) {
+
+		if !checkAuth(w, r) {
+			return
+		}
+
+		r.ParseForm()
+
+		entryId, err := strconv.Atoi(r.Form.Get("entry_id"))
+		if err != nil {
+			w.WriteHeader(400)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		host := getHost(r)
+
+		entryDir := filepath.Join(sourceDir, host, strconv.Itoa(entryId))
+
+		_, entry, err := readEntryActivity(entryDir)
+		if err != nil {
+			w.WriteHeader(404)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		tombstone, err := deleteEntry(sourceDir, serveDir, host, entryId, entry)
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		err = db.DeleteEntryTags(host, entryId)
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		err = render(db, rootUri, sourceDir, serveDir, partialProvider)
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		deleteId := activitypub.IRI(fmt.Sprintf("%s#delete", entry.ID))
+		del := activitypub.ActivityNew(deleteId, activitypub.DeleteType, tombstone)
+		del.Actor = entry.AttributedTo
+		del.To = entry.To
+		del.CC = entry.CC
+		del.Published = tombstone.Deleted
+
+		// Mentioned actors were sent the entry, so they need to know it's gone
+		mentions := getMentions(httpClient, apClient, string(entry.Source.Content.First().Value))
+
+		inboxes, err := getEntryInboxes(db, apClient, host, entry, mentions)
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		err = deliveryQueue.Enqueue(host, del, inboxes)
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		http.Redirect(w, r, "/blog/", http.StatusSeeOther)
+	})
+
+	err = importLegacyFollowers(db, serveDir)
+	if err != nil {
+		return nil, err
+	}
+
+	err = render(db, rootUri, sourceDir, serveDir, partialProvider)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err.Error())
-		os.Exit(1)
+		return nil, err
+	}
+
+	// The auth server has a host to itself, and any host which isn't ours
+	// gets a 404. Domains added while we're running aren't routed until
+	// the next restart.
+	router := newHostRouter(conf.TrustedProxies)
+	router.Handle(authUri, authServer)
+
+	for _, domain := range domains {
+		mux := http.NewServeMux()
+		for _, rt := range routes {
+			mux.HandleFunc(rt.pattern, rt.handler)
+		}
+		router.Handle(domain, mux)
+	}
+
+	s := &Server{
+		conf:          conf,
+		db:            db,
+		privKey:       privKey,
+		pubKeyId:      pubKeyId,
+		deliveryQueue: deliveryQueue,
+		handler:       router,
+		done:          done,
+	}
+
+	s.httpServer = &http.Server{
+		Addr:    fmt.Sprintf(":%d", conf.Port),
+		Handler: s,
+	}
+
+	return s, nil
+}
+
+// ServeHTTP handles a request for one of the hosted domains. Once Shutdown
+// has been called it answers 503 instead.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	s.mut.Lock()
+	if s.closed {
+		s.mut.Unlock()
+		w.WriteHeader(503)
+		io.WriteString(w, errServerClosed.Error())
+		return
 	}
+	s.requests.Add(1)
+	s.mut.Unlock()
+
+	defer s.requests.Done()
 
-	err = http.ListenAndServe(fmt.Sprintf(":%d", conf.Port), nil)
+	s.handler.ServeHTTP(w, r)
+}
+
+// Start delivers queued activities in the background and serves HTTP on the
+// configured port. It blocks until ctx is canceled, at which point it shuts
+// down gracefully, or until Shutdown is called. A Server can't be started
+// again after it's shut down.
+func (s *Server) Start(ctx context.Context) error {
+
+	err := s.startDelivery()
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err.Error())
-		os.Exit(1)
+		return err
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.httpServer.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errCh:
+		if errors.Is(err, http.ErrServerClosed) {
+			return nil
+		}
+		return err
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		return s.Shutdown(shutdownCtx)
+	}
+}
+
+// startDelivery runs the delivery workers, unless they're already running.
+// They're only started by Start, so a Server used through ServeHTTP just
+// queues deliveries.
+func (s *Server) startDelivery() error {
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if s.closed {
+		return errServerClosed
+	}
+
+	if s.stopDelivery != nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.stopDelivery = cancel
+	s.deliveryDone = make(chan struct{})
+
+	go func() {
+		s.deliveryQueue.Run(ctx)
+		close(s.deliveryDone)
+	}()
+
+	return nil
+}
+
+// Shutdown stops accepting connections and requests, then waits for
+// in-flight requests and deliveries to finish before closing the database.
+// Deliveries which haven't started stay queued for next time. If ctx runs
+// out first, Shutdown returns its error and the database is closed once the
+// stragglers are done.
+func (s *Server) Shutdown(ctx context.Context) error {
+
+	httpErr := s.httpServer.Shutdown(ctx)
+
+	s.mut.Lock()
+	stopDelivery := s.stopDelivery
+	deliveryDone := s.deliveryDone
+	alreadyClosed := s.closed
+	s.closed = true
+	s.mut.Unlock()
+
+	if alreadyClosed {
+		return httpErr
 	}
 
-	s := &Server{}
-	return s
+	close(s.done)
+
+	if stopDelivery != nil {
+		stopDelivery()
+	}
+
+	idle := make(chan struct{})
+	go func() {
+		if deliveryDone != nil {
+			<-deliveryDone
+		}
+		s.requests.Wait()
+		close(idle)
+	}()
+
+	select {
+	case <-idle:
+		return errors.Join(httpErr, s.db.Close())
+	case <-ctx.Done():
+		go func() {
+			<-idle
+			s.db.Close()
+		}()
+		return errors.Join(httpErr, ctx.Err())
+	}
 }
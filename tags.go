@@ -0,0 +1,153 @@
+package syndicat
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+
+	"github.com/go-ap/activitypub"
+	"github.com/valyala/fastjson"
+)
+
+const hashtagType activitypub.ActivityVocabularyType = "Hashtag"
+
+// Matches hashtags like #golang at the start of a line, after whitespace or
+// straight after an HTML tag, so URL fragments, HTML entities and attributes
+// are left alone. Tags can be in any script, but ones which are only digits
+// are skipped, same as Mastodon.
+var hashtagRegex = regexp.MustCompile(`(^|[\s>])#([\p{L}\p{N}_]*\p{L}[\p{L}\p{N}_]*)`)
+
+var invalidTagCharsRegex = regexp.MustCompile(`[^\p{L}\p{N}_-]`)
+
+// loadHashtags adds the Hashtag tags from the JSON of an entry's activity to
+// the decoded entry. Hashtag isn't part of the ActivityStreams vocabulary, so
+// go-ap drops them when decoding.
+func loadHashtags(activityBytes []byte, entry *activitypub.Object) error {
+
+	val, err := fastjson.ParseBytes(activityBytes)
+	if err != nil {
+		return err
+	}
+
+	tagVals := val.GetArray("object", "tag")
+	if tagVal := val.Get("object", "tag"); tagVal != nil && tagVal.Type() == fastjson.TypeObject {
+		tagVals = []*fastjson.Value{tagVal}
+	}
+
+	for _, tagVal := range tagVals {
+		if string(tagVal.GetStringBytes("type")) != string(hashtagType) {
+			continue
+		}
+
+		link := &activitypub.Link{}
+		err = activitypub.JSONLoadLink(tagVal, link)
+		if err != nil {
+			return err
+		}
+
+		entry.Tag = append(entry.Tag, link)
+	}
+
+	return nil
+}
+
+// normalizeTag lowercases a tag and makes it safe to use in paths, the same
+// way cmd/convert does for legacy tags.
+func normalizeTag(tag string) string {
+	tag = strings.TrimPrefix(strings.TrimSpace(tag), "#")
+	tag = strings.ToLower(strings.Replace(tag, " ", "-", -1))
+	return invalidTagCharsRegex.ReplaceAllString(tag, "")
+}
+
+// parseTags returns the unique tags for an entry, from both the hashtags in
+// its text and the comma separated tags field of the editor.
+func parseTags(text, tagsField string) []string {
+
+	tags := []string{}
+
+	addTag := func(tag string) {
+		tag = normalizeTag(tag)
+		if tag != "" && !stringInArray(tag, tags) {
+			tags = append(tags, tag)
+		}
+	}
+
+	for _, match := range hashtagRegex.FindAllStringSubmatch(text, -1) {
+		addTag(match[2])
+	}
+
+	for _, tag := range strings.Split(tagsField, ",") {
+		addTag(tag)
+	}
+
+	return tags
+}
+
+func getTagUri(domain, tag string) string {
+	return fmt.Sprintf("https://%s/tags/%s/", domain, tag)
+}
+
+// addHashtags replaces the Hashtag tags of an entry with tags.
+func addHashtags(entry *activitypub.Object, domain string, tags []string) {
+
+	entryTags := activitypub.ItemCollection{}
+
+	for _, tag := range entry.Tag {
+		if tag != nil && tag.GetType() != hashtagType {
+			entryTags = append(entryTags, tag)
+		}
+	}
+
+	for _, tag := range tags {
+		// Like mentions, these need an ID to survive decoding
+		tagUri := activitypub.IRI(getTagUri(domain, tag))
+		entryTags = append(entryTags, &activitypub.Link{
+			ID:   tagUri,
+			Type: hashtagType,
+			Href: tagUri,
+			Name: activitypub.NaturalLanguageValues{
+				activitypub.LangRefValue{
+					Value: []byte("#" + tag),
+				},
+			},
+		})
+	}
+
+	entry.Tag = entryTags
+}
+
+// getEntryTags returns the tags of an entry from its Hashtag tags.
+func getEntryTags(entry *activitypub.Object) []string {
+
+	tags := []string{}
+
+	for _, tag := range entry.Tag {
+		if tag == nil || tag.GetType() != hashtagType {
+			continue
+		}
+
+		link, err := activitypub.ToLink(tag)
+		if err != nil {
+			continue
+		}
+
+		tags = append(tags, normalizeTag(string(link.Name.First().Value)))
+	}
+
+	return tags
+}
+
+// linkHashtags turns the hashtags in rendered HTML into links to their tag
+// pages, using the markup Mastodon uses for its own hashtags. Hashtags in
+// links, code and attributes are left alone.
+func linkHashtags(contentHtml, domain string) string {
+
+	return linkHtmlText(contentHtml, hashtagRegex, func(parts []string) string {
+
+		tag := normalizeTag(parts[2])
+
+		return fmt.Sprintf(`%s<a href="%s" class="mention hashtag" rel="tag">#<span>%s</span></a>`,
+			html.EscapeString(parts[1]), html.EscapeString(getTagUri(domain, tag)), html.EscapeString(parts[2]))
+	})
+}
@@ -0,0 +1,161 @@
+package syndicat
+
+import (
+	"database/sql"
+	"errors"
+	"net/url"
+	"time"
+
+	"github.com/go-ap/activitypub"
+	"github.com/go-ap/client"
+	"github.com/go-ap/jsonld"
+)
+
+const timelineLength = 100
+
+type timelineEntry struct {
+	*ActivityPubObject
+	ActorName string
+	ActorIcon string
+	ReplyUri  string
+}
+
+// addTimelineItem stores a post in the timeline of domain, as long as the
+// domain follows its author or is mentioned in it. It returns false
+// otherwise.
+func addTimelineItem(db *SqliteDatabase, apClient *client.C, domain string, obj *activitypub.Object) (bool, error) {
+
+	actorId := obj.AttributedTo.GetLink()
+
+	if !mentionsDomain(obj, domain) {
+		following, err := db.GetFollowing(domain, string(actorId))
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+
+		if following.Status != FollowingStatusAccepted {
+			return false, nil
+		}
+	}
+
+	actor, err := getActor(apClient, actorId)
+	if err != nil {
+		return false, err
+	}
+
+	err = storeTimelineItem(db, domain, actor, obj)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// updateTimelineItem replaces the stored copies of a post after its author
+// edits it. It returns false if the post isn't in any timeline.
+func updateTimelineItem(db *SqliteDatabase, apClient *client.C, obj *activitypub.Object) (bool, error) {
+
+	items, err := db.GetTimelineItems(string(obj.ID))
+	if err != nil {
+		return false, err
+	}
+
+	if len(items) == 0 {
+		return false, nil
+	}
+
+	actorId := obj.AttributedTo.GetLink()
+
+	actor, err := getActor(apClient, actorId)
+	if err != nil {
+		return false, err
+	}
+
+	for _, item := range items {
+		if item.Actor != string(actorId) {
+			continue
+		}
+
+		if obj.Published.IsZero() {
+			obj.Published = item.Published
+		}
+
+		err = storeTimelineItem(db, item.Domain, actor, obj)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+func storeTimelineItem(db *SqliteDatabase, domain string, actor *activitypub.Actor, obj *activitypub.Object) error {
+
+	content := sanitizeHtml(string(obj.Content.First().Value))
+	obj.Content = activitypub.NaturalLanguageValues{
+		activitypub.LangRefValue{
+			Value: []byte(content),
+		},
+	}
+
+	objBytes, err := jsonld.Marshal(obj)
+	if err != nil {
+		return err
+	}
+
+	published := obj.Published
+	if published.IsZero() {
+		published = time.Now()
+	}
+
+	item := &TimelineItem{
+		Domain:    domain,
+		Id:        string(obj.ID),
+		Actor:     string(actor.ID),
+		ActorName: getActorName(actor),
+		ActorIcon: getActorIcon(actor),
+		Object:    string(objBytes),
+		Published: published,
+	}
+
+	return db.SetTimelineItem(item)
+}
+
+func getTimeline(db *SqliteDatabase, domain string) ([]*timelineEntry, error) {
+
+	items, err := db.GetTimeline(domain, timelineLength)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []*timelineEntry{}
+
+	for _, item := range items {
+		var obj *activitypub.Object
+		err = jsonld.Unmarshal([]byte(item.Object), &obj)
+		if err != nil {
+			return nil, err
+		}
+
+		renderObj, err := convertApObject(obj)
+		if err != nil {
+			return nil, err
+		}
+
+		if renderObj.HtmlUri == "" && isHttpUrl(renderObj.Id) {
+			renderObj.HtmlUri = renderObj.Id
+		}
+
+		entries = append(entries, &timelineEntry{
+			ActivityPubObject: renderObj,
+			ActorName:         item.ActorName,
+			ActorIcon:         item.ActorIcon,
+			ReplyUri:          "/entry-editor/?parent_uri=" + url.QueryEscape(renderObj.Id),
+		})
+	}
+
+	return entries, nil
+}
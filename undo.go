@@ -0,0 +1,60 @@
+package syndicat
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+
+	"github.com/go-ap/activitypub"
+)
+
+// findUndoneActivity looks up an activity of actorId's on domain, which
+// they're undoing by only sending its IRI, as Mastodon and others do for
+// Follows and Likes. It returns nil if it isn't a Follow or reaction of
+// theirs that we know of.
+func findUndoneActivity(db *SqliteDatabase, domain string, actorId, undoneId activitypub.IRI) (*activitypub.Activity, error) {
+
+	reaction, err := db.GetReaction(string(undoneId))
+	if err == nil && reaction.Actor == string(actorId) {
+		return &activitypub.Activity{
+			ID:    undoneId,
+			Type:  activitypub.ActivityVocabularyType(reaction.Type),
+			Actor: actorId,
+		}, nil
+	}
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	follower, err := db.GetFollower(domain, string(actorId))
+	if err == nil && follower.FollowId == string(undoneId) {
+		return &activitypub.Activity{
+			ID:    undoneId,
+			Type:  activitypub.FollowType,
+			Actor: actorId,
+		}, nil
+	}
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	request, err := db.GetFollowRequest(domain, string(actorId))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var follow *activitypub.Activity
+	err = json.Unmarshal([]byte(request.Activity), &follow)
+	if err != nil {
+		return nil, err
+	}
+
+	if follow.ID != undoneId {
+		return nil, nil
+	}
+
+	return follow, nil
+}
@@ -7,6 +7,8 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/alecthomas/chroma/v2/quick"
 	"github.com/go-ap/jsonld"
@@ -25,6 +27,35 @@ func writeFile(filePath string, data []byte) error {
 	return nil
 }
 
+// writeFileAtomic writes a file which is being served, by writing it next to
+// where it goes and moving it into place, so it's never seen half written.
+func writeFileAtomic(filePath string, data []byte) error {
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(filePath), "."+filepath.Base(filePath)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.Write(data)
+	if err != nil {
+		tmpFile.Close()
+		return err
+	}
+
+	err = tmpFile.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Chmod(tmpFile.Name(), 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), filePath)
+}
+
 func ensureDirWriteFile(filePath string, data []byte) error {
 	err := ensureDir(filepath.Dir(filePath))
 	if err != nil {
@@ -34,6 +65,15 @@ func ensureDirWriteFile(filePath string, data []byte) error {
 	return writeFile(filePath, data)
 }
 
+func isDir(dirPath string) bool {
+	info, err := os.Stat(dirPath)
+	if err != nil {
+		return false
+	}
+
+	return info.IsDir()
+}
+
 func printJson(data interface{}) {
 	d, _ := json.MarshalIndent(data, "", "  ")
 	//fmt.Println(string(d))
@@ -48,15 +88,35 @@ func printJsonLd(data interface{}) {
 	fmt.Println(string(d))
 }
 
+// getHost returns the host a request was made to. X-Forwarded-Host has
+// already been applied by the hostRouter, if it came from a trusted proxy.
 func getHost(r *http.Request) string {
-	// TODO: check to make sure we're behind a proxy before
-	// trusting XFH header
-	host := r.Header.Get("X-Forwarded-Host")
-	if host == "" {
-		host = r.Host
+	return r.Host
+}
+
+// wantsActivityJson checks whether a request is asking for ActivityPub JSON
+// rather than HTML.
+func wantsActivityJson(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "application/activity+json") || strings.Contains(accept, "application/ld+json")
+}
+
+// getActivityJsonPath returns the JSON version of a page which can also be
+// fetched as ActivityPub, ie the actor for / and the entry for /<id>/.
+func getActivityJsonPath(reqPath string) (string, bool) {
+
+	if reqPath == "/" {
+		return "/ap.jsonld", true
 	}
 
-	return host
+	entryIdStr := strings.Trim(reqPath, "/")
+
+	_, err := strconv.Atoi(entryIdStr)
+	if err != nil {
+		return "", false
+	}
+
+	return fmt.Sprintf("/%s/entry.jsonld", entryIdStr), true
 }
 
 func check(err error) {
@@ -64,3 +124,12 @@ func check(err error) {
 		log.Fatal(err)
 	}
 }
+
+func stringInArray(s string, a []string) bool {
+	for _, item := range a {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,176 @@
+package syndicat
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/go-ap/activitypub"
+	"github.com/go-ap/client"
+)
+
+// Entry visibility levels. These aren't stored anywhere, since they're
+// implied by how an entry is addressed.
+const (
+	// Listed everywhere and addressed to the public
+	VisibilityPublic = "public"
+	// Public, but left out of the blog, forum, feeds and tag pages
+	VisibilityUnlisted = "unlisted"
+	// Only for followers, and anyone mentioned
+	VisibilityFollowers = "followers"
+	// Only for the actors mentioned
+	VisibilityDirect = "direct"
+)
+
+type visibilityOption struct {
+	Value    string
+	Label    string
+	Selected bool
+}
+
+// ParseVisibility maps the visibility values we've used over time, including
+// those of legacy entries, to one of the visibility levels.
+func ParseVisibility(visibility string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(visibility)) {
+	case "", "public":
+		return VisibilityPublic, nil
+	case "unlisted":
+		return VisibilityUnlisted, nil
+	case "followers", "followers-only", "private":
+		return VisibilityFollowers, nil
+	case "direct":
+		return VisibilityDirect, nil
+	}
+
+	return "", fmt.Errorf("Invalid visibility %s", visibility)
+}
+
+// GetAddressing returns the to and cc for an entry on domain with the given
+// visibility, in the same way Mastodon addresses posts. Mentioned actors are
+// added separately.
+func GetAddressing(domain, visibility string) (activitypub.ItemCollection, activitypub.ItemCollection) {
+
+	followersId := activitypub.IRI(fmt.Sprintf("https://%s/followers.jsonld", domain))
+
+	switch visibility {
+	case VisibilityUnlisted:
+		return activitypub.ItemCollection{followersId}, activitypub.ItemCollection{activitypub.PublicNS}
+	case VisibilityFollowers:
+		return activitypub.ItemCollection{followersId}, activitypub.ItemCollection{}
+	case VisibilityDirect:
+		return activitypub.ItemCollection{}, activitypub.ItemCollection{}
+	}
+
+	return activitypub.ItemCollection{activitypub.PublicNS}, activitypub.ItemCollection{followersId}
+}
+
+// getVisibility works out the visibility of an entry on domain from its
+// addressing.
+func getVisibility(domain string, entry *activitypub.Object) string {
+
+	followersId := activitypub.IRI(fmt.Sprintf("https://%s/followers.jsonld", domain))
+
+	switch {
+	case entry.To.Contains(activitypub.PublicNS):
+		return VisibilityPublic
+	case entry.CC.Contains(activitypub.PublicNS):
+		return VisibilityUnlisted
+	case entry.To.Contains(followersId) || entry.CC.Contains(followersId):
+		return VisibilityFollowers
+	}
+
+	return VisibilityDirect
+}
+
+func isPublicVisibility(visibility string) bool {
+	return visibility == VisibilityPublic || visibility == VisibilityUnlisted
+}
+
+func getVisibilityOptions(selected string) []*visibilityOption {
+
+	options := []*visibilityOption{
+		{Value: VisibilityPublic, Label: "Public"},
+		{Value: VisibilityUnlisted, Label: "Unlisted"},
+		{Value: VisibilityFollowers, Label: "Followers only"},
+		{Value: VisibilityDirect, Label: "Direct (mentioned people only)"},
+	}
+
+	for _, option := range options {
+		option.Selected = option.Value == selected
+	}
+
+	return options
+}
+
+// getPrivateEntry returns the entry which reqPath is part of, if that entry
+// isn't public.
+func getPrivateEntry(sourceDir, domain, reqPath string) (*activitypub.Object, bool) {
+
+	entryIdStr := strings.Split(strings.Trim(reqPath, "/"), "/")[0]
+
+	_, err := strconv.Atoi(entryIdStr)
+	if err != nil {
+		return nil, false
+	}
+
+	_, entry, err := readEntryActivity(filepath.Join(sourceDir, domain, entryIdStr))
+	if err != nil {
+		return nil, false
+	}
+
+	if isPublicVisibility(getVisibility(domain, entry)) {
+		return nil, false
+	}
+
+	return entry, true
+}
+
+// canAccessEntry checks whether a remote actor is allowed to see a
+// non-public entry on domain, ie it's addressed to them directly or to the
+// followers they're one of.
+func canAccessEntry(db *SqliteDatabase, domain string, entry *activitypub.Object, actorId activitypub.IRI) (bool, error) {
+
+	if entry.To.Contains(actorId) || entry.CC.Contains(actorId) {
+		return true, nil
+	}
+
+	if getVisibility(domain, entry) != VisibilityFollowers {
+		return false, nil
+	}
+
+	_, err := db.GetFollower(domain, string(actorId))
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// getEntryInboxes returns the inboxes an entry and any activities about it
+// need delivering to, which depends on its visibility.
+func getEntryInboxes(db *SqliteDatabase, apClient *client.C, domain string, entry *activitypub.Object, mentions []*mention) ([]string, error) {
+
+	inboxes := []string{}
+
+	if getVisibility(domain, entry) != VisibilityDirect {
+		followers, err := db.GetFollowers(domain)
+		if err != nil {
+			return nil, err
+		}
+
+		followers, err = resolveFollowerInboxes(db, apClient, followers)
+		if err != nil {
+			return nil, err
+		}
+
+		inboxes = getDeliveryInboxes(followers)
+	}
+
+	return getMentionInboxes(mentions, inboxes), nil
+}
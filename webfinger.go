@@ -0,0 +1,106 @@
+package syndicat
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+type WebFingerAccount struct {
+	Subject string           `json:"subject"`
+	Aliases []string         `json:"aliases,omitempty"`
+	Links   []*WebFingerLink `json:"links"`
+}
+
+type WebFingerLink struct {
+	Rel  string `json:"rel"`
+	Type string `json:"type,omitempty"`
+	Href string `json:"href"`
+}
+
+var errWebFingerNotFound = errors.New("No such account")
+
+// getWebFingerAccount resolves a WebFinger resource, which can be either an
+// acct: URI or the URI of one of the hosted actors or their profile pages.
+func getWebFingerAccount(sourceDir, resource string) (*WebFingerAccount, error) {
+
+	parsedResource, err := url.Parse(resource)
+	if err != nil {
+		return nil, err
+	}
+
+	var domain string
+	var username string
+
+	switch parsedResource.Scheme {
+	case "acct":
+		parts := strings.Split(parsedResource.Opaque, "@")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid acct resource %s", resource)
+		}
+
+		username = parts[0]
+		domain = parts[1]
+	case "https":
+		domain = parsedResource.Host
+
+		switch parsedResource.Path {
+		case "", "/", "/ap.jsonld":
+		default:
+			return nil, errWebFingerNotFound
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported resource %s", resource)
+	}
+
+	if !isHostedDomain(sourceDir, domain) {
+		return nil, errWebFingerNotFound
+	}
+
+	profile, err := loadProfile(filepath.Join(sourceDir, domain))
+	if err != nil {
+		return nil, err
+	}
+
+	if username != "" && username != profile.Username {
+		return nil, errWebFingerNotFound
+	}
+
+	actorId := fmt.Sprintf("https://%s/ap.jsonld", domain)
+	profileUri := fmt.Sprintf("https://%s/", domain)
+
+	account := &WebFingerAccount{
+		Subject: fmt.Sprintf("acct:%s@%s", profile.Username, domain),
+		Aliases: []string{
+			profileUri,
+			actorId,
+		},
+		Links: []*WebFingerLink{
+			&WebFingerLink{
+				Rel:  "self",
+				Type: "application/activity+json",
+				Href: actorId,
+			},
+			&WebFingerLink{
+				Rel:  "http://webfinger.net/rel/profile-page",
+				Type: "text/html",
+				Href: profileUri,
+			},
+		},
+	}
+
+	avatarUri := profile.AvatarUri(domain)
+	if avatarUri != "" {
+		account.Links = append(account.Links, &WebFingerLink{
+			Rel:  "http://webfinger.net/rel/avatar",
+			Type: mime.TypeByExtension(path.Ext(avatarUri)),
+			Href: avatarUri,
+		})
+	}
+
+	return account, nil
+}